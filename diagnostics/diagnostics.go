@@ -0,0 +1,109 @@
+// Package diagnostics holds the positioned compile errors reported by the
+// tokenizer, the parser, the assembler and the checks run on a compiled
+// program.
+package diagnostics
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Error is a single compile error pointing at a place in the source. Line
+// is 0 when there is no source to point at, such as for a program loaded
+// from bytecode; the Message then says where the error is.
+type Error struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+	// Snippet is the offending source line followed by a caret under Column.
+	Snippet string
+}
+
+// At builds an Error for the byte at offset in source, whose 1-based line
+// and column the caller already knows.
+func At(source string, offset int, line int, column int, message string) Error {
+	return Error{Line: line, Column: column, Message: message, Snippet: snippet(source, offset)}
+}
+
+// Locate builds an Error for the byte at offset in source, working out its
+// line and column.
+func Locate(source string, offset int, message string) Error {
+	offset = min(max(offset, 0), len(source))
+	line_start := strings.LastIndexByte(source[:offset], '\n') + 1
+	line := strings.Count(source[:offset], "\n") + 1
+	return At(source, offset, line, offset-line_start+1, message)
+}
+
+func snippet(source string, offset int) string {
+	offset = min(max(offset, 0), len(source))
+	line_start := strings.LastIndexByte(source[:offset], '\n') + 1
+	line_end := len(source)
+	if i := strings.IndexByte(source[offset:], '\n'); i >= 0 {
+		line_end = offset + i
+	}
+	line := source[line_start:line_end]
+	// keep tabs in the caret line so it lines up however tabs are rendered
+	caret := []byte(source[line_start:offset])
+	for i, c := range caret {
+		if c != '\t' {
+			caret[i] = ' '
+		}
+	}
+	return line + "\n" + string(caret) + "^"
+}
+
+func (e Error) Error() string {
+	var sb strings.Builder
+	if e.File != "" {
+		sb.WriteString(e.File + ":")
+	}
+	if e.Line > 0 {
+		sb.WriteString(strconv.Itoa(e.Line) + ":" + strconv.Itoa(e.Column) + ":")
+	}
+	if sb.Len() > 0 {
+		sb.WriteString(" ")
+	}
+	sb.WriteString(e.Message)
+	if e.Snippet != "" {
+		sb.WriteString("\n" + e.Snippet)
+	}
+	return sb.String()
+}
+
+// List is every error found in one compile. A nil List means success; use
+// Err to hand it back as an error without the typed-nil trap.
+type List []Error
+
+func (l List) Error() string {
+	messages := make([]string, len(l))
+	for i, e := range l {
+		messages[i] = e.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Err returns l as an error, or nil if it is empty.
+func (l List) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// Sort puts l in source order. Errors without a position keep their order
+// and come first.
+func (l List) Sort() {
+	slices.SortStableFunc(l, func(x, y Error) int {
+		return cmp.Or(cmp.Compare(x.Line, y.Line), cmp.Compare(x.Column, y.Column))
+	})
+}
+
+// SetFile stamps file onto every error in l.
+func (l List) SetFile(file string) {
+	for i := range l {
+		l[i].File = file
+	}
+}
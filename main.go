@@ -1,693 +1,161 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"no-ast/diagnostics"
 	"no-ast/tokenizer"
-	"no-ast/utils/assert"
+	"no-ast/utils"
+	"no-ast/vm"
 	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
 )
 
-type Opcode int
-
 const (
-	OPCODE_ADD Opcode = iota
-	Invoke_function_on_stack_top
-	LoadLocal
-
-	OPCODE_SUB
-	OPCODE_MUL
-	OPCODE_DIV
-	OPCODE_EQ
-	OPCODE_GT
-	OPCODE_LT
-	Pop
-	Push
-	LoadVar
-	Assign
-	StackTopType
-	Blank
-	Return
-	JumpIfZero
-	SetLocal
-	FieldAccess
-	//
-	AccessMemory_andSkipBlanks //post program compile
+	exit_ok      = 0
+	exit_failure = 1
+	exit_usage   = 2
 )
 
-func get_type_size(t string) int {
-	switch t {
-	case "int":
-		return 4
-	case "string":
-		return 4
-	case "builtin-function":
-		return 4
-	case "function":
-		return 4
-	default:
-		panic(fmt.Sprintf("unknown type %s", t))
-	}
-}
-
-type VarInfo struct {
-	Name       string
-	Type       string
-	mem_offset int
-}
+const usage = `usage: no-ast <command> <file>
 
-type Instruction struct {
-	Opcode   Opcode
-	Operands []any
-}
-
-func (this Instruction) String() string {
-	res := ""
-	switch this.Opcode {
-	case Pop:
-		res += "POP"
-	case Push:
-		res += "PUSH"
-	case LoadVar:
-		res += "LOADVAR"
-	case Assign:
-		res += "ASSIGN"
-	case StackTopType:
-		res += "STACKTOPTYPE"
-	case Blank:
-		res += "BLANK"
-	case OPCODE_ADD:
-		res += "ADD"
-	case OPCODE_SUB:
-		res += "SUB"
-	case OPCODE_MUL:
-		res += "MUL"
-	case OPCODE_DIV:
-		res += "DIV"
-	case OPCODE_EQ:
-		res += "EQ"
-	case Invoke_function_on_stack_top:
-		res += "INVOKE_FUNCTION_ON_STACK_TOP"
-	case Return:
-		res += "RETURN"
-	case JumpIfZero:
-		res += "JUMP_IF_ZERO"
-	case LoadLocal:
-		res += "LOAD_LOCAL"
-	case OPCODE_GT:
-		res += "GT"
-	case OPCODE_LT:
-		res += "LT"
-	case FieldAccess:
-		res += "FIELD_ACCESS"
-	case AccessMemory_andSkipBlanks:
-
-		res += "ACCESS_MEMORY_AND_SKIP_BLANKS"
-	default:
-		panic(fmt.Sprintf("Unknown opcode: %d", this.Opcode))
-	}
-	for _, operand := range this.Operands {
-		res += " " + fmt.Sprint(operand)
-	}
-	return res
+commands:
+  run <file>     execute a source, .nas assembly or .nbc bytecode file
+  build <file>   compile a source or .nas file into a .nbc file next to it
+  tokens <file>  print the token stream of a source file
+  disasm <file>  print a source, .nas or .nbc file as assembly
+`
 
-}
-
-type Parser struct {
-	tokens []tokenizer.Token
-	index  int
-}
+// Files are told apart by extension; anything that is not bytecode or
+// assembly is script source.
+const (
+	bytecode_extension = ".nbc"
+	assembly_extension = ".nas"
+)
 
-func (p *Parser) in_range() bool {
-	return p.index < len(p.tokens)
+func main() {
+	os.Exit(run_cli(os.Args[1:]))
 }
 
-func (p *Parser) cur_token() tokenizer.Token {
-	return p.tokens[p.index]
-}
+func run_cli(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprint(os.Stderr, usage)
+		return exit_usage
+	}
+	command, file_name := args[0], args[1]
 
-func (p *Parser) parse_wrapped_term() []Instruction {
-	exp_byte_code := p.parse_term()
-	was_ident := exp_byte_code.Opcode != Push
-	if !was_ident {
-		return []Instruction{exp_byte_code}
+	var source string
+	if !guard("read", func() { source = utils.Get_file_contents(file_name) }) {
+		return exit_usage
 	}
-	// fmt.Print(p.cur_token().Value, "p.tokens[p.index].Value")
-	instructions := []Instruction{exp_byte_code}
-	for p.in_range() {
-		state_changed := false
-		if p.tokens[p.index].Value == "(" {
-			p.index++
-			arg_count := 0
-			for p.in_range() && p.cur_token().Value != ")" {
-				instructions = append(instructions, p.parse_expression()...)
-				arg_count++
-				if p.cur_token().Value == "," {
-					p.index++
-				} else {
-					break
-				}
-			}
-			p.expect_token(")")
-			instructions = append(instructions, Instruction{Opcode: Invoke_function_on_stack_top, Operands: []any{arg_count}})
-			state_changed = true
+
+	switch command {
+	case "run":
+		program, ok := load(file_name, source)
+		if !ok {
+			return exit_failure
 		}
-		if p.tokens[p.index].Value == "." {
-			p.index++
-			instructions = append(instructions, Instruction{Opcode: FieldAccess, Operands: []any{p.tokens[p.index].Value}})
-			p.index++
-			state_changed = true
+		if err := vm.New(program).Run(context.Background()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exit_failure
 		}
-		if !state_changed {
-			break
+	case "build":
+		program, ok := load(file_name, source)
+		if !ok {
+			return exit_failure
 		}
-	}
-	return instructions
-}
-
-func (p *Parser) expect_token(token_value string) {
-	if p.NextToken().Value != token_value {
-		panic(fmt.Sprintf("Expected token %s, got %s", token_value, p.NextToken().Value))
-	}
-}
-
-func (Instruction) InstructionOrAstNode__() {}
-
-/////ast
-
-func (astVarRef) InstructionOrAstNode__()    {}
-func (astFieldAccess) InstructionOrAstNode() {}
-
-type astVarRef struct {
-	name string
-}
-type astFieldAccess struct {
-	name string
-}
-
-type InstructionOrAstNode interface {
-	InstructionOrAstNode__()
-}
-
-/////ast
-
-func (p *Parser) parse_term() Instruction {
-	t := p.NextToken()
-	switch t.Type {
-	case tokenizer.TOKEN_NUMBER:
-		n, _ := strconv.Atoi(t.Value)
-		return Instruction{Opcode: Push, Operands: []any{TypeSafeValue{Type: "int", Data: n}}} // Instruction{Opcode: StackTopType, Operands: []any{"int"}}
-
-	case tokenizer.TOKEN_STRING:
-		return Instruction{Opcode: Push, Operands: []any{TypeSafeValue{Type: "string", Data: t.Value}}} //  Instruction{Opcode: StackTopType, Operands: []any{"string"}}
-
-	case tokenizer.TOKEN_IDENTIFIER:
-		if in_function {
-			if v, ok := current_parsing_function.local_vars[t.Value]; ok {
-				return Instruction{Opcode: LoadLocal, Operands: []any{
-					v.mem_offset, v.Type,
-				}}
-			}
+		out_name := strings.TrimSuffix(file_name, filepath.Ext(file_name)) + bytecode_extension
+		var out bytes.Buffer
+		if err := program.Save(&out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exit_failure
 		}
-		return Instruction{Opcode: LoadVar, Operands: []any{t.Value}}
-	default:
-		panic("Unexpected token: " + t.String())
-	}
-
-}
-
-func (p *Parser) parse_expression() []Instruction {
-	instructions := p.parse_wrapped_term()
-	for p.in_range() && p.tokens[p.index].Type == tokenizer.TOKEN_OPERATOR {
-		t := p.NextToken()
-		operation_byte_code := Instruction{Opcode: Blank}
-		switch t.Value {
-		case "+":
-			operation_byte_code = Instruction{Opcode: OPCODE_ADD}
-		case "-":
-			operation_byte_code = Instruction{Opcode: OPCODE_SUB}
-		case "*":
-			operation_byte_code = Instruction{Opcode: OPCODE_MUL}
-		case "==":
-			operation_byte_code = Instruction{Opcode: OPCODE_EQ}
-		case "/":
-			operation_byte_code = Instruction{Opcode: OPCODE_DIV}
-		case ">":
-			operation_byte_code = Instruction{Opcode: OPCODE_GT}
-
-		case "<":
-			operation_byte_code = Instruction{Opcode: OPCODE_LT}
-		default:
-			panic("Unexpected operator: " + t.String())
+		if err := os.WriteFile(out_name, out.Bytes(), 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exit_failure
 		}
-		right := p.parse_expression()
-		instructions = append(instructions, right...)
-		instructions = append(instructions, operation_byte_code)
-	}
-	return instructions
-}
-
-func (p *Parser) parse_statement(previous_instruction_amount int) []Instruction {
-	instructions := []Instruction{}
-	t := p.NextToken()
-	if t.Value == "return" {
-		p.index++
-		return append(instructions, Instruction{Opcode: Return, Operands: []any{}})
-	}
-	if t.Value == "if" {
-		e_instructions := p.parse_expression()
-		for _, e_instruction := range e_instructions {
-			fmt.Println("e_instruction", e_instruction)
+		fmt.Printf("%s: %d instructions\n", out_name, len(program.Instructions))
+	case "tokens":
+		tokens, err := tokenizer.TokenizeWithComments(source)
+		for _, token := range tokens {
+			fmt.Printf("%d:%d\t%s\n", token.Line, token.Column, token)
 		}
-		instructions = append(instructions, e_instructions...)
-		instructions = append(instructions, Instruction{Opcode: JumpIfZero, Operands: []any{}})
-		conditional_jump_instruction_index := len(instructions) - 1
-		p.expect_token("{")
-		for p.in_range() && p.cur_token().Value != "}" {
-			instructions = append(instructions, p.parse_statement(previous_instruction_amount+len(instructions))...)
+		if err != nil {
+			report(file_name, err)
+			return exit_failure
 		}
-		p.expect_token("}")
-		assert.Assert(instructions[conditional_jump_instruction_index].Opcode == JumpIfZero)
-		instructions[conditional_jump_instruction_index] = Instruction{Opcode: JumpIfZero, Operands: []any{previous_instruction_amount + len(instructions)}}
-		return instructions
-	}
-	if t.Value == "while" {
-		start_index := len(instructions)
-		instructions = append(instructions, p.parse_expression()...)
-		instructions = append(instructions, Instruction{Opcode: JumpIfZero, Operands: []any{}})
-		conditional_jump_instruction_index := len(instructions) - 1
-		p.expect_token("{")
-		for p.in_range() && p.cur_token().Value != "}" {
-			instructions = append(instructions, p.parse_statement(previous_instruction_amount+len(instructions))...)
+	case "disasm":
+		// a program with compile errors is still listed, as far as it got
+		var program *vm.Program
+		var err error
+		if !guard("compile", func() { program, err = translate(file_name, source) }) {
+			return exit_failure
 		}
-		p.expect_token("}")
-		instructions = append(instructions, Instruction{Opcode: Push, Operands: []any{TypeSafeValue{Type: "int", Data: 0}}})
-		instructions = append(instructions, Instruction{Opcode: JumpIfZero, Operands: []any{previous_instruction_amount + start_index}})
-		assert.Assert(instructions[conditional_jump_instruction_index].Opcode == JumpIfZero)
-		instructions[conditional_jump_instruction_index] = Instruction{Opcode: JumpIfZero, Operands: []any{previous_instruction_amount + len(instructions)}}
-		return instructions
-	}
-	if p.in_range() && p.cur_token().Value == "=" {
-		p.index++
-		if in_function {
-			if v, ok := current_parsing_function.local_vars[t.Value]; ok {
-				instructions = append(instructions, p.parse_expression()...)
-				return append(instructions, Instruction{Opcode: SetLocal, Operands: []any{
-					v.mem_offset, v.Type,
-				}})
-			}
+		if program == nil {
+			report(file_name, err)
+			return exit_failure
 		}
-		instructions = append(instructions, p.parse_expression()...)
-		return append(instructions, Instruction{Opcode: Assign, Operands: []any{t.Value}})
-	}
-	if p.in_range() && p.cur_token().Value == "(" {
-		p.index--
-		return append(instructions, p.parse_wrapped_term()...)
-	}
-	panic("Unexpected statement: " + t.String())
-
-}
-func (p *Parser) NextToken() tokenizer.Token {
-	if !p.in_range() {
-		return tokenizer.Token{Type: tokenizer.TOKEN_EOF, Value: ""}
-	}
-	token := p.tokens[p.index]
-	p.index++
-	return token
-}
-
-func print_sum(nums []any) {
-	sum := 0
-	for _, num := range nums {
-		sum += num.(int)
-	}
-	fmt.Println(sum)
-}
-
-func print_all(args []any) {
-	for _, arg := range args {
-		fmt.Println(arg)
-	}
-}
-
-func print_one(args []any) {
-	fmt.Println(args[0].(int))
-}
-
-var vars = map[string]VarInfo{
-	"x":                              VarInfo{Name: "x", Type: "int", mem_offset: 0},
-	"y":                              VarInfo{Name: "y", Type: "int", mem_offset: 1},
-	"print_all":                      VarInfo{Name: "print_all", Type: "builtin-function", mem_offset: 2},
-	"print_one":                      VarInfo{Name: "print_one", Type: "builtin-function", mem_offset: 3},
-	"done":                           VarInfo{Name: "done", Type: "builtin-function", mem_offset: 4},
-	"Address":                        VarInfo{Name: "Address", Type: "class", mem_offset: 5},
-	"person":                         VarInfo{Name: "person", Type: "Person", mem_offset: 6},
-	"person::field::age":             VarInfo{Name: "person", Type: "Person", mem_offset: 7},
-	"person::field::bench":           VarInfo{Name: "person", Type: "Person", mem_offset: 8},
-	"person::field::address":         VarInfo{Name: "person", Type: "Person", mem_offset: 9},
-	"person::field::address::number": VarInfo{Name: "person", Type: "Person", mem_offset: 10},
-	"Person":                         VarInfo{Name: "Person", Type: "class", mem_offset: 11},
-}
-
-type StackFrame struct {
-	return_address              int
-	function_locals_start_index int
-}
-type Function struct {
-	Name                    string
-	param_types             []string
-	return_type             string
-	instruction_start_index int
-	local_vars              map[string]VarInfo
-}
-
-type Class struct {
-	Name       string
-	fieldsInfo map[string]VarInfo
-}
-
-var memory = make([]any, 100)
-var bytecode []Instruction
-
-var current_parsing_function = Function{}
-var in_function = false
-
-func build_program() {
-
-	source := `
-	x = 0
-	while x < 3{
-		x = x + 1
-		print_added(person.age) 
-		print_added(person.highest_bench) 
-		print_one(person.address.number) 
-		print_added(3) 
-		print_added(4) 
-		print_added(5) 
-		
-		} 
-
-	x = 0
-	while x < 10 {
-		x = x + 1
-		print_one(4+x*10)
-	}
-	x = 1
-	if x{
-		print_one(1) 
-		print_one(2) 
-		print_one(3) 
-		print_one(4) 
-		print_one(5) 
+		fmt.Print(program.Disassemble())
+		if err != nil {
+			report(file_name, err)
+			return exit_failure
 		}
-				print_added(x) 
-				y = 1+90-7 
-				x=y+2 
-				print_one(y)
-				print_one(x)
-				
-				print_one(x) 
-				
-				
-				done()
-				defers(x)
-	`
-	bytecode = block_instructions(source, 0)
-	memory[vars["x"].mem_offset] = 0
-	memory[vars["y"].mem_offset] = 0
-	memory[vars["print_all"].mem_offset] = print_all
-	memory[vars["print_one"].mem_offset] = print_one
-	memory[vars["done"].mem_offset] = func([]any) {
-		fmt.Println("done the program")
-		os.Exit(0)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		return exit_usage
 	}
-	memory[vars["Person"].mem_offset] = Class{Name: "Person", fieldsInfo: map[string]VarInfo{
-		"age":           VarInfo{Name: "age", Type: "int", mem_offset: 0},
-		"highest_bench": VarInfo{Name: "age", Type: "int", mem_offset: 1},
-		"address":       VarInfo{Name: "address", Type: "Address", mem_offset: 2},
-	}}
-	memory[vars["Address"].mem_offset] = Class{Name: "Address", fieldsInfo: map[string]VarInfo{
-		"street": VarInfo{Name: "street", Type: "int", mem_offset: 0},
-		"number": VarInfo{Name: "number", Type: "int", mem_offset: 1},
-	}}
-	memory[vars["person"].mem_offset] = 22
-	memory[vars["person"].mem_offset+1] = 150
-	memory[vars["person"].mem_offset+2] = 2
-	memory[vars["person"].mem_offset+3] = 426
-	function_header := Function{Name: "print_added", param_types: []string{"int"}, return_type: "void", instruction_start_index: len(bytecode), local_vars: map[string]VarInfo{
-		"num": VarInfo{Name: "num", Type: "int", mem_offset: 0},
-	}}
-	makeFunction(function_header, "print_added", `
-												print_one(num+num)
-												return`)
-
-	function_header = Function{Name: "defers", param_types: []string{"int"}, return_type: "void", instruction_start_index: len(bytecode), local_vars: map[string]VarInfo{
-		"x": VarInfo{Name: "x", Type: "int", mem_offset: 0},
-	}}
-	makeFunction(function_header, "defers", `
-					print_one(x+1001)
-				`)
-
+	return exit_ok
 }
 
-func makeFunction(function_header Function, function_name string, block_code string) {
-	current_parsing_function = function_header
-	in_function = true
-	vars[function_name] = VarInfo{Name: function_name, Type: "function", mem_offset: len(vars)}
-	memory[vars[function_name].mem_offset] = function_header
-	body_instructions := block_instructions(block_code, len(bytecode))
-	fmt.Println(function_name, "instructions")
-	for _, instruction := range body_instructions {
-		fmt.Println("\t", instruction)
-		bytecode = append(bytecode, instruction)
+// translate turns the contents of file_name into a Program according to
+// its extension: bytecode is loaded, assembly assembled and anything else
+// compiled as source.
+func translate(file_name string, contents string) (*vm.Program, error) {
+	switch filepath.Ext(file_name) {
+	case bytecode_extension:
+		return vm.Load(strings.NewReader(contents))
+	case assembly_extension:
+		return vm.Assemble(contents)
+	default:
+		return vm.Compile(contents)
 	}
-	current_parsing_function = Function{}
-	in_function = false
 }
 
-type TypeSafeValue struct {
-	Type string
-	Data any
-}
-
-var stack = make([]TypeSafeValue, 0)
-var frames = make([]StackFrame, 0)
-
-func block_instructions(source string, previous_instruction_amount int) []Instruction {
-	tokens := tokenizer.Tokenize(source)
-	for _, token := range tokens {
-		fmt.Println(token.String())
+// load translates file_name, printing whatever went wrong.
+func load(file_name string, contents string) (*vm.Program, bool) {
+	var program *vm.Program
+	var err error
+	if !guard("compile", func() { program, err = translate(file_name, contents) }) {
+		return nil, false
 	}
-	p := Parser{tokens: tokens, index: 0}
-	return p.parse_block(previous_instruction_amount)
-}
-
-func (p *Parser) parse_block(previous_instruction_amount int) []Instruction {
-	bytecode := []Instruction{}
-	for p.in_range() && p.cur_token().Type != tokenizer.TOKEN_EOF {
-		for _, instruction := range p.parse_statement(len(bytecode) + previous_instruction_amount) {
-			fmt.Println(instruction)
-			bytecode = append(bytecode, instruction)
-		}
+	if err != nil {
+		report(file_name, err)
+		return nil, false
 	}
-	return bytecode
+	return program, true
 }
 
-func testing() {
-	source := `42 > a`
-	p := Parser{tokens: tokenizer.Tokenize(source), index: 0}
-	fmt.Println("tokens")
-	for _, tok := range p.tokens {
-		fmt.Println("\t", tok)
-	}
-	bytecode := p.parse_expression()
-	for _, instruction := range bytecode {
-		fmt.Println(instruction)
+// report prints err, stamping file_name onto every error in it.
+func report(file_name string, err error) {
+	if list, ok := err.(diagnostics.List); ok {
+		list.SetFile(file_name)
+		fmt.Fprintln(os.Stderr, err)
+		return
 	}
+	fmt.Fprintf(os.Stderr, "%s: %v\n", file_name, err)
 }
 
-func main() {
-	// testing()
-
-	// os.Exit(0)
-	build_program()
-	instruction_ptr := 0
-	for instruction_ptr < len(bytecode) {
-	ProcessInstruction:
-		instruction := bytecode[instruction_ptr]
-		// for stack_thing := range stack {
-		// 	displayStruct.Print(stack_thing)
-		// }
-		// displayStruct.Print(instruction)
-		switch instruction.Opcode {
-		case LoadVar:
-			type_, mem_offset, lookaheadAmount := compile_memory_access(instruction_ptr)
-			bytecode[instruction_ptr] = Instruction{Opcode: AccessMemory_andSkipBlanks, Operands: []any{mem_offset, type_, get_type_size(type_), instruction_ptr + lookaheadAmount}}
-			instruction = bytecode[instruction_ptr]
-			goto ProcessInstruction
-		case Assign:
-			name := instruction.Operands[0].(string)
-			data := stack_pop()
-			mem_offset := vars[name].mem_offset
-			memory[mem_offset] = data.Data
-		case OPCODE_ADD:
-			right := stack_pop()
-			left := stack_pop()
-			stack = append(stack, TypeSafeValue{Type: "int", Data: left.Data.(int) + right.Data.(int)})
-		case OPCODE_SUB:
-			right := stack_pop()
-			left := stack_pop()
-			if left.Type != "int" || right.Type != "int" {
-				panic("sub on non-int")
-			}
-			stack = append(stack, TypeSafeValue{Type: "int", Data: left.Data.(int) - right.Data.(int)})
-		case OPCODE_MUL:
-			right := stack_pop()
-			left := stack_pop()
-			stack = append(stack, TypeSafeValue{Type: "int", Data: left.Data.(int) * right.Data.(int)})
-		case OPCODE_DIV:
-			right := stack_pop()
-			left := stack_pop()
-			stack = append(stack, TypeSafeValue{Type: "int", Data: left.Data.(int) / right.Data.(int)})
-		case LoadLocal:
-			offset := instruction.Operands[0].(int)
-			type_ := instruction.Operands[1].(string)
-			var_stack_index := frames[len(frames)-1].function_locals_start_index + offset
-			stack = append(stack, TypeSafeValue{Type: type_, Data: stack[var_stack_index].Data})
-		case SetLocal:
-			offset := instruction.Operands[0].(int)
-			type_ := instruction.Operands[1].(string)
-			var_stack_index := frames[len(frames)-1].function_locals_start_index + offset
-			if stack[var_stack_index].Type != type_ {
-				assert.Assert(stack[len(stack)-1].Type != type_, "something has gone wrong within the compiler")
-				panic(fmt.Sprintf("expected %s, got %s", type_, stack[var_stack_index].Type))
-			}
-			stack[var_stack_index].Data = stack_pop().Data
-		case Push:
-			stack = append(stack, instruction.Operands[0].(TypeSafeValue))
-		case Invoke_function_on_stack_top:
-			arg_count := instruction.Operands[0].(int)
-			// println(arg_count, "arg_count")
-			function := stack[len(stack)-1-arg_count]
-			if function.Type == "builtin-function" {
-				args := make([]any, arg_count)
-				for i := 0; i < arg_count; i++ {
-					args[i] = stack[len(stack)-arg_count+i].Data
-				}
-				function.Data.(func([]any))(args)
-				stack = stack[:len(stack)-1-arg_count]
-
-			} else if function.Type == "function" {
-				if len(function.Data.(Function).param_types) != arg_count {
-					panic(fmt.Sprintf("expected %d args, got %d", len(function.Data.(Function).param_types), arg_count))
-				}
-				for i := 0; i < arg_count; i++ {
-					if function.Data.(Function).param_types[i] != stack[len(stack)-arg_count+i].Type {
-						panic(fmt.Sprintf("expected %s, got %s for arg %d", function.Data.(Function).param_types[i], stack[len(stack)-arg_count+i].Type, i))
-					}
-				}
-				frames = append(frames, StackFrame{return_address: instruction_ptr + 1, function_locals_start_index: len(stack) - arg_count})
-				instruction_ptr = function.Data.(Function).instruction_start_index
-				continue
-			} else {
-				panic("unhandled Invoke_function_on_stack_top")
-			}
-
-		case JumpIfZero:
-			if stack[len(stack)-1].Type != "int" {
-				panic("jump_if_zero on non-int")
-			}
-			if stack_pop().Data.(int) == 0 {
-				instruction_ptr = instruction.Operands[0].(int)
-				continue
-			}
-		case Return:
-			if len(frames) == 0 {
-				panic("return from main")
-			}
-			frame := frames[len(frames)-1]
-			frames = frames[:len(frames)-1]
-			stack = stack[:frame.function_locals_start_index]
-			instruction_ptr = frame.return_address
-			continue
-		case OPCODE_GT:
-			right := stack_pop()
-			left := stack_pop()
-			if left.Type != "int" || right.Type != "int" {
-				panic("sub on non-int")
-			}
-			if left.Data.(int) > right.Data.(int) {
-				stack = append(stack, TypeSafeValue{Type: "int", Data: 1})
-			} else {
-				stack = append(stack, TypeSafeValue{Type: "int", Data: 0})
-			}
-		case OPCODE_LT:
-			right := stack_pop()
-			left := stack_pop()
-			if left.Type != "int" || right.Type != "int" {
-				panic("sub on non-int")
-			}
-			if left.Data.(int) < right.Data.(int) {
-				stack = append(stack, TypeSafeValue{Type: "int", Data: 1})
-			} else {
-				stack = append(stack, TypeSafeValue{Type: "int", Data: 0})
-			}
-		case OPCODE_EQ:
-			right := stack_pop()
-			left := stack_pop()
-			if left.Type != "int" || right.Type != "int" {
-				panic("sub on non-int")
-			}
-			if left.Data.(int) == right.Data.(int) {
-				stack = append(stack, TypeSafeValue{Type: "int", Data: 1})
-			} else {
-				stack = append(stack, TypeSafeValue{Type: "int", Data: 0})
-			}
-		case AccessMemory_andSkipBlanks:
-			offset := instruction.Operands[0].(int)
-			type_ := instruction.Operands[1].(string)
-			// type_size := instruction.Operands[2].(int)
-			stack = append(stack, TypeSafeValue{Type: type_, Data: memory[offset]})
-			{
-				i := instruction_ptr + 1
-				for i < instruction.Operands[3].(int) {
-					if bytecode[i].Opcode != FieldAccess {
-
-						panic(fmt.Sprintf("not a FieldAccess but rather is %v", bytecode[i]))
-					}
-					i++
-				}
-			}
-			instruction_ptr = instruction.Operands[3].(int)
-			continue
-		default:
-			panic(fmt.Sprintf("unhandled " + instruction.String()))
+// guard runs f and turns a panic into a message on stderr tagged with stage,
+// so the driver can map failures onto exit codes instead of crashing.
+func guard(stage string, f func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "%s error: %v\n", stage, r)
+			ok = false
 		}
-		instruction_ptr++
-	}
-}
-
-func compile_memory_access(instruction_ptr int) (string, int, int) {
-	var instruction Instruction = bytecode[instruction_ptr]
-	assert.Assert(instruction.Opcode == LoadVar)
-	name := instruction.Operands[0].(string)
-	type_ := vars[name].Type
-	mem_offset := vars[name].mem_offset
-	//
-	lookaheadAmount := 1
-	for bytecode[instruction_ptr+lookaheadAmount].Opcode == FieldAccess {
-		println("lookaheadAmount", lookaheadAmount)
-		c := memory[vars[type_].mem_offset].(Class)
-		field_info := c.fieldsInfo[bytecode[instruction_ptr+lookaheadAmount].Operands[0].(string)]
-		mem_offset += field_info.mem_offset
-		type_ = field_info.Type
-		lookaheadAmount++
-	}
-	return type_, mem_offset, lookaheadAmount
-}
-
-func stack_pop() TypeSafeValue {
-	v := stack[len(stack)-1]
-	stack = stack[:len(stack)-1]
-	return v
+	}()
+	f()
+	return true
 }
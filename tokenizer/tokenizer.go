@@ -1,5 +1,13 @@
 package tokenizer
 
+import (
+	"fmt"
+	"no-ast/diagnostics"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
 const (
 	TOKEN_EOF = iota
 	TOKEN_IDENTIFIER
@@ -8,21 +16,32 @@ const (
 	TOKEN_ASSIGN
 	TOKEN_Punctuation
 	TOKEN_STRING
+	TOKEN_COMMENT
 )
 
 type Token struct {
 	Type  int
 	Value string
+	// Line and Column are 1-based; Offset is the byte index into the source.
+	Line   int
+	Column int
+	Offset int
 }
 
 type Tokenizer struct {
 	input       string
 	position    int
 	currentChar byte
+	line        int
+	column      int
+	errors      diagnostics.List
+	// KeepComments makes NextToken return TOKEN_COMMENT tokens instead of
+	// skipping comments, for tools that care about them.
+	KeepComments bool
 }
 
 func NewTokenizer(input string) *Tokenizer {
-	t := &Tokenizer{input: input, position: 0}
+	t := &Tokenizer{input: input, position: 0, line: 1, column: 1}
 	if len(input) > 0 {
 		t.currentChar = input[0]
 	}
@@ -30,6 +49,12 @@ func NewTokenizer(input string) *Tokenizer {
 }
 
 func (t *Tokenizer) advance() {
+	if t.currentChar == '\n' {
+		t.line++
+		t.column = 1
+	} else {
+		t.column++
+	}
 	t.position++
 	if t.position >= len(t.input) {
 		t.currentChar = 0
@@ -38,19 +63,51 @@ func (t *Tokenizer) advance() {
 	}
 }
 
+func (t *Tokenizer) peek() byte {
+	if t.position+1 >= len(t.input) {
+		return 0
+	}
+	return t.input[t.position+1]
+}
+
 func (t *Tokenizer) skipWhitespace() {
 	for t.currentChar != 0 && (t.currentChar == ' ' || t.currentChar == '\t' || t.currentChar == '\n' || t.currentChar == '\r') {
 		t.advance()
 	}
 }
 
+// readNumber reads an integer or a float such as 3.14, 1e9 or 2.5e-3. A dot
+// or an e only belongs to the number when digits follow it.
 func (t *Tokenizer) readNumber() string {
-	result := ""
-	for t.currentChar != 0 && ((t.currentChar >= '0' && t.currentChar <= '9') || t.currentChar == '.') {
-		result += string(t.currentChar)
+	start_index := t.position
+	t.skipDigits()
+	if t.currentChar == '.' && is_digit(t.peek()) {
 		t.advance()
+		t.skipDigits()
 	}
-	return result
+	if t.currentChar == 'e' || t.currentChar == 'E' {
+		exponent := t.position + 1
+		if exponent < len(t.input) && (t.input[exponent] == '+' || t.input[exponent] == '-') {
+			exponent++
+		}
+		if exponent < len(t.input) && is_digit(t.input[exponent]) {
+			for t.position < exponent {
+				t.advance()
+			}
+			t.skipDigits()
+		}
+	}
+	return t.input[start_index:t.position]
+}
+
+func (t *Tokenizer) skipDigits() {
+	for is_digit(t.currentChar) {
+		t.advance()
+	}
+}
+
+func is_digit(c byte) bool {
+	return c >= '0' && c <= '9'
 }
 
 func (t *Tokenizer) readIdentifier() string {
@@ -62,54 +119,206 @@ func (t *Tokenizer) readIdentifier() string {
 	return result
 }
 
-func (t *Tokenizer) NextToken() Token {
-	for t.currentChar != 0 {
-		t.skipWhitespace()
-		if t.position >= len(t.input) {
-			return Token{Type: TOKEN_EOF, Value: ""}
-		}
-
-		if t.currentChar >= '0' && t.currentChar <= '9' {
-			return Token{Type: TOKEN_NUMBER, Value: t.readNumber()}
+// readComment reads a `// ...` comment up to the end of the line or a
+// `/* ... */` comment, which may nest, and returns its full text.
+func (t *Tokenizer) readComment() string {
+	start_index := t.position
+	if t.peek() == '/' {
+		for t.currentChar != 0 && t.currentChar != '\n' {
+			t.advance()
 		}
-
-		if (t.currentChar >= 'a' && t.currentChar <= 'z') || (t.currentChar >= 'A' && t.currentChar <= 'Z') || t.currentChar == '_' {
-			return Token{Type: TOKEN_IDENTIFIER, Value: t.readIdentifier()}
+		return t.input[start_index:t.position]
+	}
+	open_line, open_column := t.line, t.column
+	depth := 0
+	for {
+		if t.position >= len(t.input) {
+			t.errors = append(t.errors, diagnostics.At(t.input, start_index, open_line, open_column, "unterminated block comment"))
+			return t.input[start_index:]
 		}
-
-		switch t.currentChar {
-		case '+', '-', '*', '/', '=', '>', '<':
-			c := t.currentChar
+		if t.currentChar == '/' && t.peek() == '*' {
+			depth++
 			t.advance()
-			if t.currentChar == '=' {
-				token := Token{Type: TOKEN_OPERATOR, Value: string([]rune{rune(c), rune('=')})}
-				t.advance()
-				return token
-			}
-			if c == '=' {
-				return Token{Type: TOKEN_ASSIGN, Value: string(c)}
-			}
-			return Token{Type: TOKEN_OPERATOR, Value: string(c)}
-		case '\'', '"':
-			string_char := t.currentChar
+		} else if t.currentChar == '*' && t.peek() == '/' {
+			depth--
 			t.advance()
-			start_index := t.position
-			for t.currentChar != string_char {
+			if depth == 0 {
 				t.advance()
+				return t.input[start_index:t.position]
 			}
-			token := Token{Type: TOKEN_STRING, Value: t.input[start_index:t.position]}
+		}
+		t.advance()
+	}
+}
+
+// readString reads a '...' or "..." literal and decodes its escape
+// sequences. The literal has to end on the line it starts on; raw strings are
+// the way to write one that spans lines.
+func (t *Tokenizer) readString() string {
+	quote := t.currentChar
+	quote_line, quote_column, quote_offset := t.line, t.column, t.position
+	t.advance()
+	var sb strings.Builder
+	for t.currentChar != quote {
+		if t.position >= len(t.input) || t.currentChar == '\n' {
+			t.errors = append(t.errors, diagnostics.At(t.input, quote_offset, quote_line, quote_column, "unterminated string literal"))
+			return sb.String()
+		}
+		if t.currentChar == '\\' {
+			t.readEscape(&sb)
+			continue
+		}
+		sb.WriteByte(t.currentChar)
+		t.advance()
+	}
+	t.advance()
+	return sb.String()
+}
+
+// readEscape decodes the escape sequence at the current backslash into sb:
+// \n, \t, \r, \0, \\, \", \' or \u{...} with up to six hex digits.
+func (t *Tokenizer) readEscape(sb *strings.Builder) {
+	line, column, offset := t.line, t.column, t.position
+	fail := func(message string) {
+		t.errors = append(t.errors, diagnostics.At(t.input, offset, line, column, message))
+	}
+	t.advance()
+	switch c := t.currentChar; c {
+	case 'n':
+		sb.WriteByte('\n')
+	case 't':
+		sb.WriteByte('\t')
+	case 'r':
+		sb.WriteByte('\r')
+	case '0':
+		sb.WriteByte(0)
+	case '\\', '"', '\'':
+		sb.WriteByte(c)
+	case 'u':
+		t.advance()
+		if t.currentChar != '{' {
+			fail("malformed \\u escape; expected \\u{hex digits}")
+			return
+		}
+		t.advance()
+		digits_start := t.position
+		for t.position < len(t.input) && strings.IndexByte("0123456789abcdefABCDEF", t.currentChar) >= 0 {
 			t.advance()
+		}
+		digits := t.input[digits_start:t.position]
+		if t.currentChar != '}' || digits == "" || len(digits) > 6 {
+			fail("malformed \\u escape; expected \\u{hex digits}")
+			return
+		}
+		code_point, _ := strconv.ParseUint(digits, 16, 32)
+		if !utf8.ValidRune(rune(code_point)) {
+			fail(fmt.Sprintf("\\u{%s} is not a valid code point", digits))
+		} else {
+			sb.WriteRune(rune(code_point))
+		}
+	case 0, '\n':
+		// leave the end of the line for readString to report
+		return
+	default:
+		fail(fmt.Sprintf("unknown escape sequence \\%c", c))
+	}
+	t.advance()
+}
+
+// readRawString reads a `...` literal, which may span lines and has no
+// escape sequences.
+func (t *Tokenizer) readRawString() string {
+	quote_line, quote_column, quote_offset := t.line, t.column, t.position
+	t.advance()
+	start_index := t.position
+	for t.currentChar != '`' {
+		if t.position >= len(t.input) {
+			t.errors = append(t.errors, diagnostics.At(t.input, quote_offset, quote_line, quote_column, "unterminated raw string literal"))
+			return t.input[start_index:]
+		}
+		t.advance()
+	}
+	value := t.input[start_index:t.position]
+	t.advance()
+	return value
+}
+
+// error records a diagnostic at the tokenizer's current position.
+func (t *Tokenizer) error(message string) {
+	t.errors = append(t.errors, diagnostics.At(t.input, t.position, t.line, t.column, message))
+}
+
+// NextToken returns the next token stamped with where it starts, skipping
+// (and reporting) any characters that cannot start a token.
+func (t *Tokenizer) NextToken() Token {
+	for {
+		t.skipWhitespace()
+		line, column, offset := t.line, t.column, t.position
+		if token, ok := t.scan(); ok {
+			token.Line, token.Column, token.Offset = line, column, offset
 			return token
+		}
+	}
+}
 
-		case '(', ')', ';', ',', '.', '?', '{', '}':
-			token := Token{Type: TOKEN_Punctuation, Value: string(t.currentChar)}
+// scan reads one token starting at the current character. It returns false
+// when there is no token to hand out: after a skipped comment, or after
+// reporting a character that cannot start a token.
+func (t *Tokenizer) scan() (Token, bool) {
+	if t.position >= len(t.input) {
+		return Token{Type: TOKEN_EOF, Value: ""}, true
+	}
+
+	if t.currentChar == '/' && (t.peek() == '/' || t.peek() == '*') {
+		comment := t.readComment()
+		return Token{Type: TOKEN_COMMENT, Value: comment}, t.KeepComments
+	}
+
+	if t.currentChar >= '0' && t.currentChar <= '9' {
+		return Token{Type: TOKEN_NUMBER, Value: t.readNumber()}, true
+	}
+
+	if (t.currentChar >= 'a' && t.currentChar <= 'z') || (t.currentChar >= 'A' && t.currentChar <= 'Z') || t.currentChar == '_' {
+		return Token{Type: TOKEN_IDENTIFIER, Value: t.readIdentifier()}, true
+	}
+
+	switch t.currentChar {
+	case '+', '-', '*', '/', '=', '>', '<', '!':
+		c := t.currentChar
+		t.advance()
+		if t.currentChar == '=' {
+			token := Token{Type: TOKEN_OPERATOR, Value: string([]rune{rune(c), rune('=')})}
 			t.advance()
-			return token
-		default:
-			panic("Unknown character: " + string(t.currentChar))
+			return token, true
+		}
+		if c == '=' {
+			return Token{Type: TOKEN_ASSIGN, Value: string(c)}, true
 		}
+		return Token{Type: TOKEN_OPERATOR, Value: string(c)}, true
+	case '&', '|':
+		c := t.currentChar
+		if t.peek() != c {
+			t.error(fmt.Sprintf("unknown character %q; did you mean %c%c?", c, c, c))
+			t.advance()
+			return Token{}, false
+		}
+		t.advance()
+		t.advance()
+		return Token{Type: TOKEN_OPERATOR, Value: string([]byte{c, c})}, true
+	case '\'', '"':
+		return Token{Type: TOKEN_STRING, Value: t.readString()}, true
+	case '`':
+		return Token{Type: TOKEN_STRING, Value: t.readRawString()}, true
+
+	case '(', ')', ';', ',', '.', '?', '{', '}', '[', ']', ':':
+		token := Token{Type: TOKEN_Punctuation, Value: string(t.currentChar)}
+		t.advance()
+		return token, true
+	default:
+		t.error(fmt.Sprintf("unknown character %q", t.currentChar))
+		t.advance()
+		return Token{}, false
 	}
-	return Token{Type: TOKEN_EOF, Value: ""}
 }
 
 // Helper function to get token type name
@@ -127,14 +336,31 @@ func (t Token) String() string {
 		return "ASSIGN(" + t.Value + ")"
 	case TOKEN_Punctuation:
 		return "PUNCTUATION(" + t.Value + ")"
+	case TOKEN_STRING:
+		return "STRING(" + t.Value + ")"
+	case TOKEN_COMMENT:
+		return "COMMENT(" + t.Value + ")"
 	default:
 		return "UNKNOWN_TOKEN"
 	}
 }
 
-// Tokenize function to get all tokens at once
-func Tokenize(input string) []Token {
+// Tokenize function to get all tokens at once. Characters it cannot make
+// sense of are skipped and reported in the returned diagnostics.List; the
+// token slice always ends with TOKEN_EOF.
+func Tokenize(input string) ([]Token, error) {
+	return tokenize(NewTokenizer(input))
+}
+
+// TokenizeWithComments is Tokenize, but comments come back as TOKEN_COMMENT
+// tokens instead of being dropped.
+func TokenizeWithComments(input string) ([]Token, error) {
 	t := NewTokenizer(input)
+	t.KeepComments = true
+	return tokenize(t)
+}
+
+func tokenize(t *Tokenizer) ([]Token, error) {
 	var tokens []Token
 	for {
 		token := t.NextToken()
@@ -143,5 +369,5 @@ func Tokenize(input string) []Token {
 			break
 		}
 	}
-	return tokens
+	return tokens, t.errors.Err()
 }
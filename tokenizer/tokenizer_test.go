@@ -0,0 +1,135 @@
+package tokenizer
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// token_strings is every token but the closing EOF, as Token.String prints
+// it.
+func token_strings(tokens []Token) []string {
+	var out []string
+	for _, token := range tokens[:len(tokens)-1] {
+		out = append(out, token.String())
+	}
+	return out
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"empty", "", nil},
+		{"let", "let x = 1", []string{"IDENTIFIER(let)", "IDENTIFIER(x)", "ASSIGN(=)", "NUMBER(1)"}},
+		{"comparisons", "a == b != c <= d >= e < f > g", []string{
+			"IDENTIFIER(a)", "OPERATOR(==)", "IDENTIFIER(b)", "OPERATOR(!=)", "IDENTIFIER(c)", "OPERATOR(<=)",
+			"IDENTIFIER(d)", "OPERATOR(>=)", "IDENTIFIER(e)", "OPERATOR(<)", "IDENTIFIER(f)", "OPERATOR(>)", "IDENTIFIER(g)",
+		}},
+		{"logic", "!a && b || c", []string{"OPERATOR(!)", "IDENTIFIER(a)", "OPERATOR(&&)", "IDENTIFIER(b)", "OPERATOR(||)", "IDENTIFIER(c)"}},
+		{"floats", "1.5 2e3 4.25E-2 7", []string{"NUMBER(1.5)", "NUMBER(2e3)", "NUMBER(4.25E-2)", "NUMBER(7)"}},
+		{"punctuation", "s[1:2]", []string{"IDENTIFIER(s)", "PUNCTUATION([)", "NUMBER(1)", "PUNCTUATION(:)", "NUMBER(2)", "PUNCTUATION(])"}},
+		{"line comment", "a // b c\nd", []string{"IDENTIFIER(a)", "IDENTIFIER(d)"}},
+		{"block comment", "a /* b\nc */ d", []string{"IDENTIFIER(a)", "IDENTIFIER(d)"}},
+		{"nested block comment", "a /* b /* c */ d */ e", []string{"IDENTIFIER(a)", "IDENTIFIER(e)"}},
+		{"division is not a comment", "a / b", []string{"IDENTIFIER(a)", "OPERATOR(/)", "IDENTIFIER(b)"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tokens, err := Tokenize(test.input)
+			if err != nil {
+				t.Fatalf("Tokenize(%q): %v", test.input, err)
+			}
+			if got := token_strings(tokens); !slices.Equal(got, test.want) {
+				t.Errorf("Tokenize(%q) = %v, want %v", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`"plain"`, "plain"},
+		{`'single'`, "single"},
+		{`"a\nb\tc\rd"`, "a\nb\tc\rd"},
+		{`"nul\0"`, "nul\x00"},
+		{`"q\"q\'q\\"`, `q"q'q\`},
+		{`'it\'s'`, "it's"},
+		{`"\u{41}\u{e9}\u{1F600}"`, "Aé😀"},
+		{"`raw\\n\nlines`", "raw\\n\nlines"},
+	}
+	for _, test := range tests {
+		tokens, err := Tokenize(test.input)
+		if err != nil {
+			t.Errorf("Tokenize(%s): %v", test.input, err)
+			continue
+		}
+		if tokens[0].Type != TOKEN_STRING || tokens[0].Value != test.want {
+			t.Errorf("Tokenize(%s) = %v, want STRING(%s)", test.input, tokens[0], test.want)
+		}
+	}
+}
+
+func TestTokenizeErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		// want is every error, each as line:column: message
+		want []string
+	}{
+		{`"abc`, []string{"1:1: unterminated string literal"}},
+		{"x = \"ab\ny", []string{"1:5: unterminated string literal"}},
+		{"`abc", []string{"1:1: unterminated raw string literal"}},
+		{"a /* b", []string{"1:3: unterminated block comment"}},
+		{`"\q"`, []string{"1:2: unknown escape sequence \\q"}},
+		{`"\u41"`, []string{"1:2: malformed \\u escape; expected \\u{hex digits}"}},
+		{`"\u{110000}"`, []string{"1:2: \\u{110000} is not a valid code point"}},
+		{"a & b", []string{"1:3: unknown character '&'; did you mean &&?"}},
+		{"a $ b\n# c", []string{"1:3: unknown character '$'", "2:1: unknown character '#'"}},
+	}
+	for _, test := range tests {
+		_, err := Tokenize(test.input)
+		if err == nil {
+			t.Errorf("Tokenize(%q) succeeded, want %v", test.input, test.want)
+			continue
+		}
+		var got []string
+		for _, line := range strings.Split(err.Error(), "\n") {
+			// skip the snippet and caret lines after each error
+			if len(line) > 0 && line[0] >= '1' && line[0] <= '9' && strings.Contains(line, ": ") {
+				got = append(got, line)
+			}
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("Tokenize(%q) errors = %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	tokens, err := Tokenize("let x\n  = 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ line, column, offset int }{{1, 1, 0}, {1, 5, 4}, {2, 3, 8}, {2, 5, 10}}
+	for i, w := range want {
+		if got := tokens[i]; got.Line != w.line || got.Column != w.column || got.Offset != w.offset {
+			t.Errorf("token %d %v at %d:%d+%d, want %d:%d+%d", i, got, got.Line, got.Column, got.Offset, w.line, w.column, w.offset)
+		}
+	}
+}
+
+func TestKeepComments(t *testing.T) {
+	tokens, err := TokenizeWithComments("a // note\nb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"IDENTIFIER(a)", "COMMENT(// note)", "IDENTIFIER(b)"}
+	if got := token_strings(tokens); !slices.Equal(got, want) {
+		t.Errorf("TokenizeWithComments = %v, want %v", got, want)
+	}
+}
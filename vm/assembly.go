@@ -0,0 +1,494 @@
+package vm
+
+import (
+	"fmt"
+	"maps"
+	"no-ast/diagnostics"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Assembly is the textual form of a Program's instructions, one per line:
+//
+//	; a comment runs to the end of the line
+//	.class Point x:int y:int
+//	                      declares a class with its fields in order
+//	.var x int            declares a global of a primitive or class type
+//	    JUMP skip
+//	.fn twice n:int -> int
+//	                      declares a function whose body starts at the next
+//	    LOAD_LOCAL 0 int  instruction; leave out -> for a void function
+//	    LOAD_LOCAL 0 int
+//	    ADD
+//	    RETURN
+//	skip:
+//	loop:                 a label names the instruction after it
+//	    LOADVAR x         globals, fields and types are bare words
+//	    PUSH {int 3}      constants are {int N}, {float F}, {bool true},
+//	                      {string "quoted"} or {void}
+//	    LT
+//	    JUMP_IF_FALSE end  jump targets are labels or instruction indices
+//	    JUMP loop
+//	end:
+//
+// Mnemonics are the ones Instruction.String prints.
+
+// Assemble parses assembly source into a Program. Its globals are the
+// registered builtins plus whatever it declares with .class, .var and .fn.
+// A function body has to sit behind a jump over it, as compiled functions
+// do. On failure the error is a diagnostics.List covering every bad line,
+// or every line that reads a variable that does not exist or mixes up
+// types.
+func Assemble(source string) (*Program, error) {
+	program := new_program()
+	program.source = source
+	a := assembler{source: source, program: program, labels: map[string]int{}}
+	a.parse_lines()
+	program.Instructions = a.resolve()
+	// labels are checked before operands; report in source order regardless
+	a.errors.Sort()
+	if len(a.errors) > 0 {
+		return program, a.errors
+	}
+	return program, program.prepare()
+}
+
+// Disassemble prints the program's instructions as assembly, naming jump
+// targets L0, L1, ... in the order they appear so that listings of similar
+// programs diff cleanly.
+func (program *Program) Disassemble() string {
+	instructions := program.Instructions
+	var targets []int
+	for _, instruction := range instructions {
+		if is_jump(instruction.Opcode) {
+			targets = append(targets, instruction.Operands[0])
+		}
+	}
+	slices.Sort(targets)
+	labels := map[int]string{}
+	for _, target := range slices.Compact(targets) {
+		labels[target] = fmt.Sprintf("L%d", len(labels))
+	}
+
+	var sb strings.Builder
+	// globals are declared in memory order, which puts every class before
+	// its uses; functions are declared where their bodies start
+	functions := map[int]Function{}
+	globals := slices.Collect(maps.Values(program.vars))
+	slices.SortFunc(globals, func(a, b VarInfo) int { return a.mem_offset - b.mem_offset })
+	for _, v := range globals {
+		switch v.Type {
+		case "builtin-function":
+		case "function":
+			function := program.memory[v.mem_offset].(Function)
+			functions[function.instruction_start_index] = function
+		case "class":
+			sb.WriteString(".class " + v.Name)
+			fields := slices.Collect(maps.Values(program.lookup_class(v.Name).fieldsInfo))
+			slices.SortFunc(fields, func(a, b VarInfo) int { return a.mem_offset - b.mem_offset })
+			for _, field := range fields {
+				sb.WriteString(" " + field.Name + ":" + field.Type)
+			}
+			sb.WriteString("\n")
+		default:
+			sb.WriteString(".var " + v.Name + " " + v.Type + "\n")
+		}
+	}
+	for i, instruction := range instructions {
+		if function, ok := functions[i]; ok {
+			sb.WriteString(".fn " + function.Name)
+			for j, param_type := range function.param_types {
+				sb.WriteString(" " + function.param_name(j) + ":" + param_type)
+			}
+			if function.return_type != "void" {
+				sb.WriteString(" -> " + function.return_type)
+			}
+			sb.WriteString("\n")
+		}
+		if label, ok := labels[i]; ok {
+			sb.WriteString(label + ":\n")
+		}
+		sb.WriteString("\t")
+		if is_jump(instruction.Opcode) {
+			sb.WriteString(opcode_names[instruction.Opcode] + " " + labels[instruction.Operands[0]])
+		} else {
+			sb.WriteString(program.format(instruction))
+		}
+		sb.WriteString("\n")
+	}
+	if label, ok := labels[len(instructions)]; ok {
+		sb.WriteString(label + ":\n")
+	}
+	return sb.String()
+}
+
+func is_jump(opcode Opcode) bool {
+	return opcode == Jump || opcode == JumpIfFalse || is_short_circuit(opcode)
+}
+
+// opcodes_by_name maps mnemonics back to the opcodes assembly may use; the
+// ones the VM only creates while running are left out.
+var opcodes_by_name = func() map[string]Opcode {
+	opcodes := map[string]Opcode{}
+	for opcode := range operand_layouts {
+		opcodes[opcode_names[opcode]] = opcode
+	}
+	return opcodes
+}()
+
+// asm_field is one whitespace separated word of an assembly line.
+type asm_field struct {
+	text   string
+	offset int
+}
+
+// asm_line is an instruction waiting for its jump labels to be resolved.
+type asm_line struct {
+	mnemonic asm_field
+	operands []asm_field
+}
+
+type assembler struct {
+	source  string
+	program *Program
+	lines   []asm_line
+	labels  map[string]int
+	errors  diagnostics.List
+}
+
+func (a *assembler) fail(offset int, format string, args ...any) {
+	a.errors = append(a.errors, diagnostics.Locate(a.source, offset, fmt.Sprintf(format, args...)))
+}
+
+// parse_lines splits the source into labels and instructions.
+func (a *assembler) parse_lines() {
+	offset := 0
+	for _, line := range strings.SplitAfter(a.source, "\n") {
+		fields, ok := a.split_fields(line, offset)
+		offset += len(line)
+		if !ok {
+			continue
+		}
+		for len(fields) > 0 && strings.HasSuffix(fields[0].text, ":") {
+			name := strings.TrimSuffix(fields[0].text, ":")
+			if _, ok := a.labels[name]; ok {
+				a.fail(fields[0].offset, "label %s is already defined", name)
+			} else if !is_label_name(name) {
+				a.fail(fields[0].offset, "bad label name %q", name)
+			}
+			a.labels[name] = len(a.lines)
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0].text {
+		case ".var":
+			a.declare_global(fields)
+		case ".class":
+			a.declare_class(fields)
+		case ".fn":
+			a.declare_function(fields)
+		default:
+			a.lines = append(a.lines, asm_line{mnemonic: fields[0], operands: fields[1:]})
+		}
+	}
+}
+
+// declare_global handles `.var name type`.
+func (a *assembler) declare_global(fields []asm_field) {
+	if len(fields) != 3 {
+		a.fail(fields[0].offset, ".var takes a name and a type")
+		return
+	}
+	name, type_ := fields[1], fields[2]
+	if _, ok := a.program.vars[name.text]; ok {
+		a.fail(name.offset, "%s is already declared", name.text)
+		return
+	}
+	if !a.program.is_data_type(type_.text) {
+		a.fail(type_.offset, "unknown type %s", type_.text)
+		return
+	}
+	v := a.program.allocate_global(name.text, type_.text)
+	a.program.zero_memory(v.mem_offset, v.Type)
+}
+
+// declare_class handles `.class name field:type ...`, laying the fields out
+// in order just as a class declaration in source does.
+func (a *assembler) declare_class(fields []asm_field) {
+	if len(fields) < 2 {
+		a.fail(fields[0].offset, ".class takes a name and its fields")
+		return
+	}
+	name := fields[1]
+	if _, ok := a.program.vars[name.text]; ok {
+		a.fail(name.offset, "%s is already declared", name.text)
+		return
+	}
+	class := Class{Name: name.text, fieldsInfo: map[string]VarInfo{}}
+	size := 0
+	for _, field := range fields[2:] {
+		field_name, field_type, ok := a.typed_name(field)
+		if !ok {
+			return
+		}
+		if _, ok := class.fieldsInfo[field_name]; ok {
+			a.fail(field.offset, "duplicate field %s in %s", field_name, name.text)
+			return
+		}
+		if !a.program.is_data_type(field_type) {
+			a.fail(field.offset, "unknown type %s", field_type)
+			return
+		}
+		class.fieldsInfo[field_name] = VarInfo{Name: field_name, Type: field_type, mem_offset: size}
+		size += a.program.get_type_size(field_type)
+	}
+	a.program.memory[a.program.allocate_global(name.text, "class").mem_offset] = class
+}
+
+// declare_function handles `.fn name param:type ... [-> type]`, whose body
+// starts at the next instruction.
+func (a *assembler) declare_function(fields []asm_field) {
+	if len(fields) < 2 {
+		a.fail(fields[0].offset, ".fn takes a name, its parameters and an optional -> type")
+		return
+	}
+	name := fields[1]
+	if _, ok := a.program.vars[name.text]; ok {
+		a.fail(name.offset, "%s is already declared", name.text)
+		return
+	}
+	function := Function{Name: name.text, return_type: "void", local_vars: map[string]VarInfo{}, instruction_start_index: len(a.lines)}
+	params := fields[2:]
+	if n := len(params); n >= 2 && params[n-2].text == "->" {
+		function.return_type = params[n-1].text
+		if !is_primitive(function.return_type) {
+			a.fail(params[n-1].offset, "functions must return an int, a float, a bool or a string, got %s", function.return_type)
+			return
+		}
+		params = params[:n-2]
+	}
+	for _, param := range params {
+		param_name, param_type, ok := a.typed_name(param)
+		if !ok {
+			return
+		}
+		if _, ok := function.local_vars[param_name]; ok {
+			a.fail(param.offset, "duplicate parameter %s in %s", param_name, name.text)
+			return
+		}
+		if !is_primitive(param_type) {
+			a.fail(param.offset, "parameter %s must be an int, a float, a bool or a string, got %s", param_name, param_type)
+			return
+		}
+		function.local_vars[param_name] = VarInfo{Name: param_name, Type: param_type, mem_offset: len(function.param_types)}
+		function.param_types = append(function.param_types, param_type)
+	}
+	a.program.memory[a.program.allocate_global(name.text, "function").mem_offset] = function
+}
+
+// typed_name splits a name:type field.
+func (a *assembler) typed_name(field asm_field) (string, string, bool) {
+	name, type_, ok := strings.Cut(field.text, ":")
+	if !ok || name == "" || type_ == "" {
+		a.fail(field.offset, "expected name:type, got %s", field.text)
+		return "", "", false
+	}
+	return name, type_, true
+}
+
+func is_label_name(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, c := range name {
+		if c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !('0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// split_fields breaks line, which starts at offset in the source, into
+// fields, keeping {...} constants and quoted strings whole and dropping any
+// comment.
+func (a *assembler) split_fields(line string, offset int) ([]asm_field, bool) {
+	var fields []asm_field
+	i := 0
+	for i < len(line) {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+			continue
+		case c == ';':
+			return fields, true
+		}
+		start := i
+		depth := 0
+		for i < len(line) {
+			c := line[i]
+			if c == '"' {
+				end := quoted_string_end(line, i)
+				if end < 0 {
+					a.fail(offset+i, "unterminated string")
+					return nil, false
+				}
+				i = end
+				continue
+			}
+			if depth == 0 && (c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == ';') {
+				break
+			}
+			if c == '{' {
+				depth++
+			} else if c == '}' {
+				depth--
+			}
+			i++
+		}
+		if depth != 0 {
+			a.fail(offset+start, "unbalanced braces")
+			return nil, false
+		}
+		fields = append(fields, asm_field{text: line[start:i], offset: offset + start})
+	}
+	return fields, true
+}
+
+// quoted_string_end returns the index just past the string literal starting
+// at line[start], or -1 if it does not end on this line.
+func quoted_string_end(line string, start int) int {
+	for i := start + 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		case '\n':
+			return -1
+		}
+	}
+	return -1
+}
+
+// resolve turns the parsed lines into instructions, checking operands
+// against operand_layouts and replacing labels with instruction indices.
+func (a *assembler) resolve() []Instruction {
+	instructions := make([]Instruction, 0, len(a.lines))
+	for _, line := range a.lines {
+		opcode, ok := opcodes_by_name[line.mnemonic.text]
+		if !ok {
+			a.fail(line.mnemonic.offset, "unknown instruction %s", line.mnemonic.text)
+			continue
+		}
+		layout := operand_layouts[opcode]
+		if len(line.operands) != len(layout) {
+			a.fail(line.mnemonic.offset, "%s takes %d operands, got %d", line.mnemonic.text, len(layout), len(line.operands))
+			continue
+		}
+		instruction := Instruction{Opcode: opcode}.at(line.mnemonic.offset)
+		for i, kind := range layout {
+			operand, problem := a.operand(opcode, kind, line.operands[i].text)
+			if problem != "" {
+				a.fail(line.operands[i].offset, "%s", problem)
+			}
+			instruction.Operands[i] = operand
+		}
+		instructions = append(instructions, instruction)
+	}
+	return instructions
+}
+
+// operand parses one operand of opcode, returning what is wrong with it if
+// it does not fit kind.
+func (a *assembler) operand(opcode Opcode, kind operand_kind, text string) (int, string) {
+	switch kind {
+	case operand_int:
+		if is_jump(opcode) {
+			if target, ok := a.labels[text]; ok {
+				return target, ""
+			}
+		}
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			if is_jump(opcode) {
+				return 0, fmt.Sprintf("undefined label %s", text)
+			}
+			return 0, fmt.Sprintf("expected an integer, got %s", text)
+		}
+		if is_jump(opcode) && (n < 0 || n > len(a.lines)) {
+			return 0, fmt.Sprintf("jump target %d is outside the program", n)
+		}
+		return n, ""
+	case operand_name:
+		if strings.HasPrefix(text, "\"") {
+			s, err := strconv.Unquote(text)
+			if err != nil {
+				return 0, fmt.Sprintf("bad string %s", text)
+			}
+			return a.program.name(s), ""
+		}
+		if strings.ContainsAny(text, "{}") {
+			return 0, fmt.Sprintf("expected a name, got %s", text)
+		}
+		return a.program.name(text), ""
+	case operand_constant:
+		v, problem := parse_value(text)
+		return a.program.constant(v), problem
+	}
+	return 0, ""
+}
+
+// parse_value reads a constant in the form TypeSafeValue.String prints.
+func parse_value(text string) (TypeSafeValue, string) {
+	if !strings.HasPrefix(text, "{") || !strings.HasSuffix(text, "}") {
+		return void_value, fmt.Sprintf("expected a constant like {int 3}, got %s", text)
+	}
+	type_, data, _ := strings.Cut(strings.TrimSpace(text[1:len(text)-1]), " ")
+	data = strings.TrimSpace(data)
+	switch type_ {
+	case "int":
+		n, err := strconv.Atoi(data)
+		if err != nil {
+			return void_value, fmt.Sprintf("bad int constant %s", text)
+		}
+		return TypeSafeValue{Type: "int", Data: n}, ""
+	case "float":
+		f, err := strconv.ParseFloat(data, 64)
+		if err != nil {
+			return void_value, fmt.Sprintf("bad float constant %s", text)
+		}
+		return TypeSafeValue{Type: "float", Data: f}, ""
+	case "bool":
+		if data != "true" && data != "false" {
+			return void_value, fmt.Sprintf("bad bool constant %s", text)
+		}
+		return TypeSafeValue{Type: "bool", Data: data == "true"}, ""
+	case "string":
+		s, err := strconv.Unquote(data)
+		if err != nil {
+			return void_value, fmt.Sprintf("bad string constant %s", text)
+		}
+		return TypeSafeValue{Type: "string", Data: s}, ""
+	case "void":
+		if data != "" {
+			return void_value, fmt.Sprintf("void constant %s has data", text)
+		}
+		return void_value, ""
+	default:
+		return void_value, fmt.Sprintf("unsupported constant type %s", type_)
+	}
+}
+
+// param_name returns the name of function's i-th parameter.
+func (function Function) param_name(i int) string {
+	for name, v := range function.local_vars {
+		if v.mem_offset == i {
+			return name
+		}
+	}
+	return fmt.Sprintf("p%d", i)
+}
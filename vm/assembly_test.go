@@ -0,0 +1,139 @@
+package vm
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAssemble(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"counting loop", `.var x int
+	PUSH {int 0}
+	ASSIGN x
+loop:
+	LOADVAR x
+	PUSH {int 3}
+	LT
+	JUMP_IF_FALSE end
+	LOADVAR print_one
+	LOADVAR x
+	INVOKE_FUNCTION_ON_STACK_TOP 1
+	POP
+	LOADVAR x
+	PUSH {int 1}
+	ADD
+	ASSIGN x
+	JUMP loop
+end:`, lines("0", "1", "2")},
+		{"constants", `	LOADVAR print_all
+	PUSH {float 2.5}
+	PUSH {bool true}
+	PUSH {string "a \"q\""} ; a comment
+	INVOKE_FUNCTION_ON_STACK_TOP 3
+	POP`, lines("2.5", "true", `a "q"`)},
+		{"functions and classes", `.class Point x:int y:int
+.var p Point
+	JUMP after
+.fn twice n:int -> int
+	LOAD_LOCAL 0 int
+	LOAD_LOCAL 0 int
+	ADD
+	RETURN
+after:
+	LOADVAR twice
+	PUSH {int 4}
+	INVOKE_FUNCTION_ON_STACK_TOP 1
+	ASSIGN p
+	FIELD_ACCESS y
+	LOADVAR print_one
+	LOADVAR p
+	FIELD_ACCESS y
+	INVOKE_FUNCTION_ON_STACK_TOP 1
+	POP`, lines("8")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			program, err := Assemble(test.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := run_program(t, program)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("printed %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{"unknown instruction", "\tFROB", []string{"1:2: unknown instruction FROB"}},
+		{"parser placeholder", "\tBLANK", []string{"1:2: unknown instruction BLANK"}},
+		{"operand count", "\tPUSH", []string{"1:2: PUSH takes 1 operands, got 0"}},
+		{"undefined label", "\tJUMP nowhere", []string{"1:7: undefined label nowhere"}},
+		{"duplicate label", "a:\na:\n\tHALT", []string{"2:1: label a is already defined"}},
+		{"bad constant", "\tPUSH 3", []string{"1:7: expected a constant like {int 3}, got 3"}},
+		{"errors in source order", "\tJUMP nowhere\n\tFROB", []string{"1:7: undefined label nowhere", "2:2: unknown instruction FROB"}},
+		{"unknown global type", ".var x Nope", []string{"1:8: unknown type Nope"}},
+		{"bad field", ".class P x", []string{"1:10: expected name:type, got x"}},
+		{"bad return type", ".fn f -> P", []string{"1:10: functions must return an int, a float, a bool or a string, got P"}},
+		{"link error", "\tLOADVAR nope\n\tPOP", []string{"1:2: unknown variable nope"}},
+		{"type error", "\tPUSH {int 1}\n\tPUSH {bool true}\n\tADD\n\tPOP", []string{"3:2: ADD needs two numbers or two strings, got int and bool"}},
+		{"function not behind a jump", ".fn f\n\tPUSH {void}\n\tRETURN", []string{"2:2: f does not start behind a jump over its body", "3:2: return outside of a function"}},
+		{"function runs off its body", "\tJUMP after\n.fn f -> int\n\tPUSH {int 1}\n\tPOP\nafter:", []string{"4:2: missing return: f can leave its body without returning"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Assemble(test.source)
+			if err == nil {
+				t.Fatalf("Assemble succeeded, want %q", test.want)
+			}
+			if got := error_lines(err); !slices.Equal(got, test.want) {
+				t.Errorf("errors %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// TestDisassembleRoundTrip checks that disassembling a program gives
+// assembly for the same program.
+func TestDisassembleRoundTrip(t *testing.T) {
+	for _, name := range examples {
+		t.Run(name, func(t *testing.T) {
+			program, err := Compile(read_example(t, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := run_program(t, program)
+			if err != nil {
+				t.Fatal(err)
+			}
+			listing := program.Disassemble()
+			assembled, err := Assemble(listing)
+			if err != nil {
+				t.Fatalf("%v\n%s", err, listing)
+			}
+			got, err := run_program(t, assembled)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("assembled listing printed %q, want %q", got, want)
+			}
+			if again := assembled.Disassemble(); again != listing {
+				t.Errorf("listing changed after assembling it:\n%s\nwant\n%s", again, listing)
+			}
+		})
+	}
+}
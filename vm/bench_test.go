@@ -0,0 +1,105 @@
+package vm
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+)
+
+// compile_example compiles one of the examples.
+func compile_example(b *testing.B, name string) *Program {
+	source, err := os.ReadFile("../examples/" + name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	program, err := Compile(string(source))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return program
+}
+
+// benchmark_example times running one of the examples with its output
+// discarded. Compiling happens once, outside the timed loop.
+func benchmark_example(b *testing.B, name string) {
+	program := compile_example(b, name)
+	b.ReportAllocs()
+	for b.Loop() {
+		machine := New(program)
+		machine.Stdout = io.Discard
+		if err := machine.Run(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoop(b *testing.B)    { benchmark_example(b, "loop.src") }
+func BenchmarkDemo(b *testing.B)    { benchmark_example(b, "demo.src") }
+func BenchmarkStrings(b *testing.B) { benchmark_example(b, "strings.src") }
+
+// BenchmarkDispatch reads every operand of the loop example the way the VM
+// dispatches on them, leaving out the work the instructions do. The any
+// operands case is the baseline to compare against: instructions used to
+// carry their operands as []any, each read a type assertion, with names
+// and constants held in the operands instead of in the Program's pools.
+func BenchmarkDispatch(b *testing.B) {
+	program := compile_example(b, "loop.src")
+	type any_instruction struct {
+		Opcode   Opcode
+		Operands []any
+	}
+	layouts := make([][]operand_kind, len(program.Instructions))
+	boxed := make([]any_instruction, len(program.Instructions))
+	for i, instruction := range program.Instructions {
+		layouts[i] = operand_layouts[instruction.Opcode]
+		boxed[i].Opcode = instruction.Opcode
+		for j, kind := range layouts[i] {
+			switch operand := instruction.Operands[j]; kind {
+			case operand_int:
+				boxed[i].Operands = append(boxed[i].Operands, operand)
+			case operand_name:
+				boxed[i].Operands = append(boxed[i].Operands, program.names[operand])
+			case operand_constant:
+				boxed[i].Operands = append(boxed[i].Operands, program.constants[operand])
+			}
+		}
+	}
+	// sum keeps the compiler from dropping the reads
+	sum := 0
+	b.Run("int operands", func(b *testing.B) {
+		for b.Loop() {
+			for i, instruction := range program.Instructions {
+				for j, kind := range layouts[i] {
+					switch operand := instruction.Operands[j]; kind {
+					case operand_int:
+						sum += operand
+					case operand_name:
+						sum += len(program.names[operand])
+					case operand_constant:
+						sum += len(program.constants[operand].Type)
+					}
+				}
+			}
+		}
+	})
+	b.Run("any operands", func(b *testing.B) {
+		for b.Loop() {
+			for i, instruction := range boxed {
+				for j, kind := range layouts[i] {
+					switch operand := instruction.Operands[j]; kind {
+					case operand_int:
+						sum += operand.(int)
+					case operand_name:
+						sum += len(operand.(string))
+					case operand_constant:
+						sum += len(operand.(TypeSafeValue).Type)
+					}
+				}
+			}
+		}
+	})
+	if sum == 0 {
+		b.Log("no operands read")
+	}
+}
@@ -0,0 +1,260 @@
+package vm
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var void_value = TypeSafeValue{Type: "void"}
+
+// builtin is a registered Go function along with the signature scripts see
+// for it.
+type builtin struct {
+	name        string
+	param_types []string
+	// variadic_type is the element type of a trailing ...T parameter, or
+	// empty if the function is not variadic.
+	variadic_type string
+	return_type   string
+	takes_vm      bool
+	returns_error bool
+	fn            reflect.Value
+}
+
+var (
+	builtins_mutex sync.RWMutex
+	builtins       = map[string]*builtin{}
+)
+
+var (
+	vm_type    = reflect.TypeFor[*VM]()
+	error_type = reflect.TypeFor[error]()
+)
+
+func init() {
+	RegisterBuiltin("print_all", print_all)
+	RegisterBuiltin("print_one", print_one)
+	RegisterBuiltin("print_sum", print_sum)
+	RegisterBuiltin("done", done)
+	RegisterBuiltin("len", string_length)
+}
+
+// RegisterBuiltin makes the Go function fn callable from every script
+// compiled afterwards under name. Parameters and results may be int, float64
+// (a script float), bool, string, a type defined on one of those, or any
+// (parameters only, taking every value but void); fn may also take a leading
+// *VM, end in a variadic parameter, and return a trailing error, which fails
+// the script.
+// Calls are checked against this signature when the script is compiled and
+// again when they run. RegisterBuiltin panics if fn has any other shape or
+// name is already taken.
+func RegisterBuiltin(name string, fn any) {
+	b := new_builtin(name, reflect.ValueOf(fn))
+	builtins_mutex.Lock()
+	defer builtins_mutex.Unlock()
+	if _, ok := builtins[name]; ok {
+		panic(fmt.Sprintf("builtin %s is already registered", name))
+	}
+	builtins[name] = b
+}
+
+func new_builtin(name string, fn reflect.Value) *builtin {
+	if fn.Kind() != reflect.Func {
+		panic(fmt.Sprintf("builtin %s: %s is not a function", name, fn.Type()))
+	}
+	t := fn.Type()
+	b := &builtin{name: name, return_type: "void", fn: fn}
+	first_param := 0
+	if t.NumIn() > 0 && t.In(0) == vm_type {
+		b.takes_vm = true
+		first_param = 1
+	}
+	for i := first_param; i < t.NumIn(); i++ {
+		param := t.In(i)
+		if t.IsVariadic() && i == t.NumIn()-1 {
+			param = param.Elem()
+		}
+		script_type, ok := script_type_of(param, true)
+		if !ok {
+			panic(fmt.Sprintf("builtin %s: unsupported parameter type %s", name, param))
+		}
+		if t.IsVariadic() && i == t.NumIn()-1 {
+			b.variadic_type = script_type
+		} else {
+			b.param_types = append(b.param_types, script_type)
+		}
+	}
+	results := t.NumOut()
+	if results > 0 && t.Out(results-1) == error_type {
+		b.returns_error = true
+		results--
+	}
+	switch results {
+	case 0:
+	case 1:
+		script_type, ok := script_type_of(t.Out(0), false)
+		if !ok {
+			panic(fmt.Sprintf("builtin %s: unsupported result type %s", name, t.Out(0)))
+		}
+		b.return_type = script_type
+	default:
+		panic(fmt.Sprintf("builtin %s: too many results", name))
+	}
+	return b
+}
+
+// go_types is the Go type a script value of each primitive type holds.
+var go_types = map[string]reflect.Type{
+	"int":    reflect.TypeFor[int](),
+	"float":  reflect.TypeFor[float64](),
+	"bool":   reflect.TypeFor[bool](),
+	"string": reflect.TypeFor[string](),
+}
+
+// script_type_of maps a Go type onto the script type it carries, going by
+// its kind so that a type like `type Celsius float64` is a float too. any
+// is only accepted where the value flows from scripts into Go.
+func script_type_of(t reflect.Type, allow_any bool) (string, bool) {
+	switch {
+	case t.Kind() == reflect.Int:
+		return "int", true
+	case t.Kind() == reflect.Float64:
+		return "float", true
+	case t.Kind() == reflect.Bool:
+		return "bool", true
+	case t.Kind() == reflect.String:
+		return "string", true
+	case allow_any && t.Kind() == reflect.Interface && t.NumMethod() == 0:
+		return "any", true
+	default:
+		return "", false
+	}
+}
+
+// registered_builtins returns every registered builtin, ordered by name so
+// programs lay out their globals the same way every time.
+func registered_builtins() []*builtin {
+	builtins_mutex.RLock()
+	defer builtins_mutex.RUnlock()
+	list := make([]*builtin, 0, len(builtins))
+	for _, b := range builtins {
+		list = append(list, b)
+	}
+	slices.SortFunc(list, func(a, b *builtin) int { return strings.Compare(a.name, b.name) })
+	return list
+}
+
+// check_arguments returns what is wrong with calling b with arguments of
+// arg_types, or "" if nothing is. An empty entry in arg_types means the type
+// is not known and is not checked.
+func (b *builtin) check_arguments(arg_types []string) string {
+	if len(arg_types) < len(b.param_types) || (b.variadic_type == "" && len(arg_types) > len(b.param_types)) {
+		expected := fmt.Sprint(len(b.param_types))
+		if b.variadic_type != "" {
+			expected = "at least " + expected
+		}
+		return fmt.Sprintf("%s expects %s arguments, got %d", b.name, expected, len(arg_types))
+	}
+	for i, arg_type := range arg_types {
+		param_type := b.variadic_type
+		if i < len(b.param_types) {
+			param_type = b.param_types[i]
+		}
+		// any takes a value of every type, but void is the lack of one
+		if arg_type == "void" {
+			return fmt.Sprintf("argument %d of %s must be a value, got void", i+1, b.name)
+		}
+		if arg_type != "" && param_type != "any" && arg_type != param_type {
+			return fmt.Sprintf("argument %d of %s must be %s, got %s", i+1, b.name, param_type, arg_type)
+		}
+	}
+	return ""
+}
+
+// call runs b with args, converting them to Go values and the result back.
+func (b *builtin) call(vm *VM, args []TypeSafeValue) TypeSafeValue {
+	arg_types := make([]string, len(args))
+	for i, arg := range args {
+		arg_types[i] = arg.Type
+	}
+	if problem := b.check_arguments(arg_types); problem != "" {
+		panic(problem)
+	}
+	in := make([]reflect.Value, 0, len(args)+1)
+	if b.takes_vm {
+		in = append(in, reflect.ValueOf(vm))
+	}
+	fn_type := b.fn.Type()
+	for _, arg := range args {
+		param := fn_type.In(min(len(in), fn_type.NumIn()-1))
+		if fn_type.IsVariadic() && len(in) >= fn_type.NumIn()-1 {
+			param = param.Elem()
+		}
+		// converting makes a script float fit a Celsius parameter as well
+		// as a float64 one
+		v := reflect.New(param).Elem()
+		if arg.Data != nil {
+			v.Set(reflect.ValueOf(arg.Data).Convert(param))
+		}
+		in = append(in, v)
+	}
+	out := b.fn.Call(in)
+	if b.returns_error {
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			panic(fmt.Sprintf("%s: %v", b.name, err))
+		}
+		out = out[:len(out)-1]
+	}
+	if len(out) == 0 {
+		return void_value
+	}
+	return TypeSafeValue{Type: b.return_type, Data: out[0].Convert(go_types[b.return_type]).Interface()}
+}
+
+func print_sum(vm *VM, nums ...int) {
+	sum := 0
+	for _, num := range nums {
+		sum += num
+	}
+	fmt.Fprintln(vm.Stdout, sum)
+}
+
+func print_all(vm *VM, args ...any) {
+	for _, arg := range args {
+		if f, ok := arg.(float64); ok {
+			fmt.Fprintln(vm.Stdout, format_float(f))
+		} else {
+			fmt.Fprintln(vm.Stdout, arg)
+		}
+	}
+}
+
+// format_float prints f in the shortest form that reads back as the same
+// float, keeping a decimal point so that 2.0 does not print like the int 2.
+func format_float(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
+
+func print_one(vm *VM, n int) {
+	fmt.Fprintln(vm.Stdout, n)
+}
+
+// done stops the program once the current instruction finishes.
+func done(vm *VM) {
+	fmt.Fprintln(vm.Stdout, "done the program")
+	vm.halted = true
+}
+
+// string_length is len(s): the number of bytes in s, which s[i] and slices
+// index by.
+func string_length(s string) int {
+	return len(s)
+}
@@ -0,0 +1,92 @@
+package vm
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type celsius float64
+
+type name string
+
+// register_test_builtins registers the builtins the tests below call, once
+// however often the tests run.
+var register_test_builtins = sync.OnceFunc(func() {
+	RegisterBuiltin("test_warm", func(c celsius) celsius {
+		return c + 10
+	})
+	RegisterBuiltin("test_greet", func(n name) (name, error) {
+		if n == "" {
+			return "", errors.New("empty name")
+		}
+		return "hello " + n, nil
+	})
+	RegisterBuiltin("test_join", func(separator string, parts ...name) string {
+		words := make([]string, len(parts))
+		for i, part := range parts {
+			words[i] = string(part)
+		}
+		return strings.Join(words, separator)
+	})
+})
+
+func TestRegisteredBuiltins(t *testing.T) {
+	register_test_builtins()
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"named parameter and result types", "print_all(test_warm(21.5))", lines("31.5")},
+		{"result alongside a nil error", `print_all(test_greet("ada"))`, lines("hello ada")},
+		{"variadic", `print_all(test_join("-", "a", "b", "c"), test_join("-"))`, lines("a-b-c", "")},
+		{"result used in an expression", `print_all(len(test_greet("x")) + 1)`, lines("8")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := run_source(t, test.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("printed %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRegisteredBuiltinErrors(t *testing.T) {
+	register_test_builtins()
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{"wrong argument type", "test_warm(1)", []string{"1:10: argument 1 of test_warm must be float, got int"}},
+		{"wrong variadic argument type", `test_join("-", "a", 2)`, []string{"1:10: argument 3 of test_join must be string, got int"}},
+		{"too few arguments", "test_join()", []string{"1:10: test_join expects at least 1 arguments, got 0"}},
+		{"result of the wrong type", "let x = test_warm(1.0) + 1 && true", []string{"1:28: && needs two bools, got float"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Compile(test.source)
+			if err == nil {
+				t.Fatalf("Compile succeeded, want %q", test.want)
+			}
+			if got := error_lines(err); !slices.Equal(got, test.want) {
+				t.Errorf("errors %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRegisteredBuiltinFails(t *testing.T) {
+	register_test_builtins()
+	_, err := run_source(t, `print_all(test_greet(""))`)
+	if err == nil || !strings.Contains(err.Error(), "test_greet: empty name") {
+		t.Errorf("Run error = %v, want one containing %q", err, "test_greet: empty name")
+	}
+}
@@ -0,0 +1,594 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+)
+
+// A saved Program (.nbc) is laid out as:
+//
+//	header          magic "NBC\x00", varint format version
+//	constant pool   every string the rest of the file refers to by index
+//	globals         name, type and memory offset of every global
+//	class layouts   memory offset, name and fields of every class
+//	function table  memory offset and header of every script function
+//	builtins        memory offset and signature of every builtin it expects
+//	data            memory size, then the initial int and string cells
+//	instructions    opcode followed by operands laid out per operand_layouts
+//
+// Integers are varints and strings are constant pool indices. Opcodes are
+// stored by number, so renumbering them means bumping bytecode_version.
+const (
+	bytecode_magic   = "NBC\x00"
+	bytecode_version = 1
+)
+
+// max_memory_cells bounds the memory size a file may ask for.
+const max_memory_cells = 1 << 24
+
+// Save writes program to w in the .nbc format.
+func (program *Program) Save(w io.Writer) error {
+	e := encoder{pool_index: map[string]int{}}
+	if err := e.program(program); err != nil {
+		return err
+	}
+	var file bytes.Buffer
+	file.WriteString(bytecode_magic)
+	file.Write(binary.AppendVarint(nil, bytecode_version))
+	file.Write(binary.AppendVarint(nil, int64(len(e.pool))))
+	for _, s := range e.pool {
+		file.Write(binary.AppendVarint(nil, int64(len(s))))
+		file.WriteString(s)
+	}
+	file.Write(e.body.Bytes())
+	_, err := w.Write(file.Bytes())
+	return err
+}
+
+type encoder struct {
+	body       bytes.Buffer
+	pool       []string
+	pool_index map[string]int
+}
+
+func (e *encoder) int(n int) {
+	e.body.Write(binary.AppendVarint(nil, int64(n)))
+}
+
+func (e *encoder) string(s string) {
+	index, ok := e.pool_index[s]
+	if !ok {
+		index = len(e.pool)
+		e.pool = append(e.pool, s)
+		e.pool_index[s] = index
+	}
+	e.int(index)
+}
+
+func (e *encoder) var_infos(infos map[string]VarInfo) {
+	names := make([]string, 0, len(infos))
+	for name := range infos {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	e.int(len(names))
+	for _, name := range names {
+		e.string(name)
+		e.string(infos[name].Type)
+		e.int(infos[name].mem_offset)
+	}
+}
+
+func (e *encoder) program(program *Program) error {
+	e.var_infos(program.vars)
+
+	var classes, functions, builtin_offsets, data []int
+	for offset, cell := range program.memory {
+		switch cell.(type) {
+		case nil:
+		case Class:
+			classes = append(classes, offset)
+		case Function:
+			functions = append(functions, offset)
+		case *builtin:
+			builtin_offsets = append(builtin_offsets, offset)
+		case int, float64, bool, string:
+			data = append(data, offset)
+		default:
+			return fmt.Errorf("cannot save memory cell %d holding %T", offset, cell)
+		}
+	}
+
+	e.int(len(classes))
+	for _, offset := range classes {
+		class := program.memory[offset].(Class)
+		e.int(offset)
+		e.string(class.Name)
+		e.var_infos(class.fieldsInfo)
+	}
+
+	e.int(len(functions))
+	for _, offset := range functions {
+		function := program.memory[offset].(Function)
+		e.int(offset)
+		e.string(function.Name)
+		e.int(len(function.param_types))
+		for _, param_type := range function.param_types {
+			e.string(param_type)
+		}
+		e.string(function.return_type)
+		e.int(function.instruction_start_index)
+		e.var_infos(function.local_vars)
+	}
+
+	e.int(len(builtin_offsets))
+	for _, offset := range builtin_offsets {
+		b := program.memory[offset].(*builtin)
+		e.int(offset)
+		e.string(b.signature())
+	}
+
+	e.int(len(program.memory))
+	e.int(program.next_global_offset)
+	e.int(len(data))
+	for _, offset := range data {
+		e.int(offset)
+		if err := e.value(TypeSafeValue{Type: type_of_cell(program.memory[offset]), Data: program.memory[offset]}); err != nil {
+			return err
+		}
+	}
+
+	e.int(len(program.Instructions))
+	for i, instruction := range program.Instructions {
+		layout, ok := operand_layouts[instruction.Opcode]
+		if !ok {
+			return fmt.Errorf("cannot save instruction %d: %s", i, instruction)
+		}
+		e.int(int(instruction.Opcode))
+		for j, kind := range layout {
+			if err := e.operand(program, kind, instruction.Operands[j]); err != nil {
+				return fmt.Errorf("cannot save instruction %d: %s: %w", i, instruction, err)
+			}
+		}
+	}
+	return nil
+}
+
+func type_of_cell(cell any) string {
+	switch cell.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "float"
+	case bool:
+		return "bool"
+	}
+	return "int"
+}
+
+// operand writes names and constants out in full rather than as indices
+// into program's pools, which Load rebuilds.
+func (e *encoder) operand(program *Program, kind operand_kind, operand int) error {
+	switch kind {
+	case operand_int:
+		e.int(operand)
+	case operand_name:
+		if operand < 0 || operand >= len(program.names) {
+			return fmt.Errorf("no name %d", operand)
+		}
+		e.string(program.names[operand])
+	case operand_constant:
+		if operand < 0 || operand >= len(program.constants) {
+			return fmt.Errorf("no constant %d", operand)
+		}
+		return e.value(program.constants[operand])
+	}
+	return nil
+}
+
+func (e *encoder) value(v TypeSafeValue) error {
+	e.string(v.Type)
+	switch data := v.Data.(type) {
+	case nil:
+		if v.Type != "void" {
+			return fmt.Errorf("%s value without data", v.Type)
+		}
+	case int:
+		e.int(data)
+	case float64:
+		e.int(int(math.Float64bits(data)))
+	case bool:
+		if data {
+			e.int(1)
+		} else {
+			e.int(0)
+		}
+	case string:
+		e.string(data)
+	default:
+		return fmt.Errorf("cannot save %s value %v", v.Type, v.Data)
+	}
+	return nil
+}
+
+// signature describes b the way a saved program records it, so Load can
+// tell whether the builtin registered now is still the one it was built
+// against.
+func (b *builtin) signature() string {
+	params := slices.Clone(b.param_types)
+	if b.variadic_type != "" {
+		params = append(params, "..."+b.variadic_type)
+	}
+	return fmt.Sprintf("%s(%s) %s", b.name, strings.Join(params, ", "), b.return_type)
+}
+
+// Load reads a Program written by Save, validating the header and every
+// instruction's operands against the opcode it belongs to, then links and
+// type checks it.
+func Load(r io.Reader) (*Program, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(bytecode_magic)) {
+		return nil, errors.New("not a no-ast bytecode file")
+	}
+	d := decoder{data: data, position: len(bytecode_magic)}
+	if version := d.int(); d.err == nil && version != bytecode_version {
+		return nil, fmt.Errorf("bytecode version %d is not supported (want %d)", version, bytecode_version)
+	}
+	pool_size := d.count()
+	for i := 0; i < pool_size && d.err == nil; i++ {
+		d.pool = append(d.pool, string(d.bytes(d.count())))
+	}
+	program := d.program()
+	if d.err != nil {
+		return nil, fmt.Errorf("corrupt bytecode file at byte %d: %w", d.position, d.err)
+	}
+	if err := program.prepare_loaded(); err != nil {
+		return nil, err
+	}
+	return program, nil
+}
+
+// prepare_loaded prepares a loaded program. Decoding checks everything
+// link and the type checker take for granted in a compiled program, but
+// should a corrupt file still get past it, that is reported rather than
+// crashing the caller.
+func (program *Program) prepare_loaded() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("corrupt bytecode file: %v", r)
+		}
+	}()
+	return program.prepare()
+}
+
+type decoder struct {
+	data     []byte
+	position int
+	pool     []string
+	// err is the first problem hit; once set every read returns zero values.
+	err error
+}
+
+func (d *decoder) fail(format string, args ...any) {
+	if d.err == nil {
+		d.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (d *decoder) int() int {
+	if d.err != nil {
+		return 0
+	}
+	n, size := binary.Varint(d.data[d.position:])
+	if size <= 0 {
+		d.fail("bad integer")
+		return 0
+	}
+	d.position += size
+	return int(n)
+}
+
+// count reads a length, which can never exceed the bytes left to read.
+func (d *decoder) count() int {
+	n := d.int()
+	if n < 0 || n > len(d.data)-d.position {
+		d.fail("bad length %d", n)
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	b := d.data[d.position : d.position+n]
+	d.position += n
+	return b
+}
+
+func (d *decoder) string() string {
+	index := d.int()
+	if index < 0 || index >= len(d.pool) {
+		d.fail("bad constant pool index %d", index)
+		return ""
+	}
+	return d.pool[index]
+}
+
+func (d *decoder) var_infos() map[string]VarInfo {
+	infos := map[string]VarInfo{}
+	for n := d.count(); n > 0 && d.err == nil; n-- {
+		name := d.string()
+		infos[name] = VarInfo{Name: name, Type: d.string(), mem_offset: d.int()}
+	}
+	return infos
+}
+
+func (d *decoder) memory_offset(program *Program) int {
+	offset := d.int()
+	if offset < 0 || offset >= len(program.memory) {
+		d.fail("memory offset %d out of range", offset)
+		return 0
+	}
+	return offset
+}
+
+func (d *decoder) program() *Program {
+	program := &Program{vars: d.var_infos(), name_index: map[string]int{}, constant_index: map[TypeSafeValue]int{}}
+
+	// memory comes after the tables that fill it, so they are read first
+	// and placed once its size is known
+	type placed struct {
+		offset int
+		cell   any
+	}
+	var cells []placed
+	for n := d.count(); n > 0 && d.err == nil; n-- {
+		offset := d.int()
+		cells = append(cells, placed{offset, Class{Name: d.string(), fieldsInfo: d.var_infos()}})
+	}
+	for n := d.count(); n > 0 && d.err == nil; n-- {
+		offset := d.int()
+		function := Function{Name: d.string()}
+		for params := d.count(); params > 0 && d.err == nil; params-- {
+			function.param_types = append(function.param_types, d.string())
+		}
+		function.return_type = d.string()
+		function.instruction_start_index = d.int()
+		function.local_vars = d.var_infos()
+		cells = append(cells, placed{offset, function})
+	}
+	registered := map[string]*builtin{}
+	for _, b := range registered_builtins() {
+		registered[b.signature()] = b
+	}
+	for n := d.count(); n > 0 && d.err == nil; n-- {
+		offset := d.int()
+		signature := d.string()
+		b, ok := registered[signature]
+		if !ok && d.err == nil {
+			d.fail("no builtin registered as %s", signature)
+		}
+		cells = append(cells, placed{offset, b})
+	}
+
+	memory_size := d.int()
+	if memory_size < 0 || memory_size > max_memory_cells {
+		d.fail("bad memory size %d", memory_size)
+		return nil
+	}
+	program.memory = make([]any, memory_size)
+	program.next_global_offset = d.int()
+	for _, c := range cells {
+		if c.offset < 0 || c.offset >= memory_size {
+			d.fail("memory offset %d out of range", c.offset)
+			return nil
+		}
+		program.memory[c.offset] = c.cell
+	}
+	for name, v := range program.vars {
+		if v.mem_offset < 0 || v.mem_offset >= memory_size {
+			d.fail("global %s has memory offset %d out of range", name, v.mem_offset)
+		}
+	}
+	for n := d.count(); n > 0 && d.err == nil; n-- {
+		offset := d.memory_offset(program)
+		v := d.value()
+		if !is_primitive(v.Type) {
+			d.fail("memory cell %d holds a %s", offset, v.Type)
+		}
+		program.memory[offset] = v.Data
+	}
+	if d.err == nil {
+		d.check_globals(program)
+	}
+
+	instruction_count := d.count()
+	for i := 0; i < instruction_count && d.err == nil; i++ {
+		opcode := Opcode(d.int())
+		layout, ok := operand_layouts[opcode]
+		if !ok {
+			d.fail("instruction %d has unknown opcode %d", i, opcode)
+			break
+		}
+		instruction := Instruction{Opcode: opcode}
+		for j, kind := range layout {
+			switch kind {
+			case operand_int:
+				instruction.Operands[j] = d.int()
+			case operand_name:
+				instruction.Operands[j] = program.name(d.string())
+			case operand_constant:
+				instruction.Operands[j] = program.constant(d.value())
+			}
+		}
+		program.Instructions = append(program.Instructions, instruction)
+	}
+	for i, instruction := range program.Instructions {
+		switch operand := instruction.Operands[0]; {
+		case is_jump(instruction.Opcode) && (operand < 0 || operand > len(program.Instructions)):
+			d.fail("instruction %d jumps to %d, outside the program", i, operand)
+		case instruction.Opcode == Invoke_function_on_stack_top && operand < 0:
+			d.fail("instruction %d passes %d arguments", i, operand)
+		case instruction.Opcode == OPCODE_SLICE && operand != 0 && operand != 1:
+			d.fail("instruction %d has slice operand %d", i, operand)
+		case (instruction.Opcode == LoadLocal || instruction.Opcode == SetLocal) && operand < 0:
+			d.fail("instruction %d uses local slot %d", i, operand)
+		}
+	}
+	for _, cell := range program.memory {
+		if function, ok := cell.(Function); ok {
+			if function.instruction_start_index < 0 || function.instruction_start_index > len(program.Instructions) {
+				d.fail("function %s starts outside the program", function.Name)
+			}
+		}
+	}
+	if d.err == nil && d.position != len(d.data) {
+		d.fail("%d trailing bytes", len(d.data)-d.position)
+	}
+	return program
+}
+
+// check_globals makes sure the globals are laid out the way compiling would
+// have laid them out, which link, the type checker and the VM all rely on:
+// every class, function and builtin global names a cell holding one, class
+// fields tile their class without cycles, and the cells of every other
+// global hold values of its type.
+func (d *decoder) check_globals(program *Program) {
+	// sizes is each class's size, or -1 while its fields are being sized
+	sizes := map[string]int{}
+	var size_of func(type_ string) int
+	size_of = func(type_ string) int {
+		if is_primitive(type_) {
+			return 1
+		}
+		if size, ok := sizes[type_]; ok {
+			if size < 0 {
+				d.fail("class %s contains itself", type_)
+				return 0
+			}
+			return size
+		}
+		v, ok := program.vars[type_]
+		class, is_class := program.memory[v.mem_offset].(Class)
+		if !ok || v.Type != "class" || !is_class {
+			d.fail("unknown type %s", type_)
+			return 0
+		}
+		sizes[type_] = -1
+		fields := slices.Collect(maps.Values(class.fieldsInfo))
+		slices.SortFunc(fields, func(a, b VarInfo) int { return a.mem_offset - b.mem_offset })
+		size := 0
+		for _, field := range fields {
+			if field.mem_offset != size {
+				d.fail("field %s.%s has offset %d, want %d", type_, field.Name, field.mem_offset, size)
+				return 0
+			}
+			size += size_of(field.Type)
+			if d.err != nil {
+				return 0
+			}
+		}
+		sizes[type_] = size
+		return size
+	}
+	// check_cells reports whether the cells from offset on hold a type_
+	var check_cells func(offset int, type_ string) bool
+	check_cells = func(offset int, type_ string) bool {
+		if is_primitive(type_) {
+			return offset < len(program.memory) && holds(program.memory[offset], type_)
+		}
+		for _, field := range program.lookup_class(type_).fieldsInfo {
+			if !check_cells(offset+field.mem_offset, field.Type) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for name, v := range program.vars {
+		cell := program.memory[v.mem_offset]
+		switch v.Type {
+		case "class":
+			if class, ok := cell.(Class); !ok || class.Name != name {
+				d.fail("class %s has no class in memory", name)
+			}
+		case "function":
+			function, ok := cell.(Function)
+			if !ok || function.Name != name {
+				d.fail("function %s has no function in memory", name)
+				break
+			}
+			for _, param_type := range function.param_types {
+				if !is_primitive(param_type) {
+					d.fail("function %s takes a %s", name, param_type)
+				}
+			}
+			if !is_primitive(function.return_type) && function.return_type != "void" {
+				d.fail("function %s returns a %s", name, function.return_type)
+			}
+		case "builtin-function":
+			if b, ok := cell.(*builtin); !ok || b == nil || b.name != name {
+				d.fail("builtin %s has no builtin in memory", name)
+			}
+		default:
+			if size_of(v.Type); d.err == nil && !check_cells(v.mem_offset, v.Type) {
+				d.fail("global %s does not hold a %s", name, v.Type)
+			}
+		}
+		if d.err != nil {
+			return
+		}
+	}
+}
+
+// holds reports whether cell is a value of the primitive type_.
+func holds(cell any, type_ string) bool {
+	switch cell.(type) {
+	case int:
+		return type_ == "int"
+	case float64:
+		return type_ == "float"
+	case bool:
+		return type_ == "bool"
+	case string:
+		return type_ == "string"
+	}
+	return false
+}
+
+func (d *decoder) value() TypeSafeValue {
+	v := TypeSafeValue{Type: d.string()}
+	switch v.Type {
+	case "void":
+	case "int":
+		v.Data = d.int()
+	case "float":
+		v.Data = math.Float64frombits(uint64(d.int()))
+	case "bool":
+		switch d.int() {
+		case 0:
+			v.Data = false
+		case 1:
+			v.Data = true
+		default:
+			d.fail("bool value is neither 0 nor 1")
+		}
+	case "string":
+		v.Data = d.string()
+	default:
+		d.fail("unsupported value type %q", v.Type)
+	}
+	return v
+}
@@ -0,0 +1,108 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// save returns program in the .nbc format.
+func save(t *testing.T, program *Program) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := program.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	for _, name := range examples {
+		t.Run(name, func(t *testing.T) {
+			program, err := Compile(read_example(t, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := run_program(t, program)
+			if err != nil {
+				t.Fatal(err)
+			}
+			saved := save(t, program)
+			loaded, err := Load(bytes.NewReader(saved))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := run_program(t, loaded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("loaded program printed %q, want %q", got, want)
+			}
+			if again := save(t, loaded); !bytes.Equal(again, saved) {
+				t.Error("saving the loaded program gives different bytes")
+			}
+		})
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	program, err := Compile(read_example(t, "demo.src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := save(t, program)
+	other_version := append([]byte(bytecode_magic), binary.AppendVarint(nil, bytecode_version+1)...)
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "not a no-ast bytecode file"},
+		{"wrong magic", []byte("#!/bin/sh\n"), "not a no-ast bytecode file"},
+		{"other version", other_version, "bytecode version 2 is not supported"},
+		{"truncated", saved[:len(saved)/2], "corrupt bytecode file"},
+		{"trailing bytes", append(bytes.Clone(saved), 0), "trailing bytes"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Load(bytes.NewReader(test.data))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Load error = %v, want one containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+// TestLoadCorrupt flips bytes all over a saved program; Load has to report
+// every corruption it notices as an error rather than panic, and decoding
+// should notice it before link or the type checker trip over it.
+func TestLoadCorrupt(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, name := range examples {
+		program, err := Compile(read_example(t, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := save(t, program)
+		for i := 0; i < 5000; i++ {
+			data := bytes.Clone(saved)
+			for n := rng.Intn(4) + 1; n > 0; n-- {
+				data[rng.Intn(len(data))] ^= byte(rng.Intn(255) + 1)
+			}
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("%s: Load panicked on mutation %d: %v", name, i, r)
+					}
+				}()
+				_, err := Load(bytes.NewReader(data))
+				if err != nil && strings.HasPrefix(err.Error(), "corrupt bytecode file: ") {
+					t.Errorf("%s: mutation %d got past decoding: %v", name, i, err)
+				}
+			}()
+		}
+	}
+}
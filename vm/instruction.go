@@ -0,0 +1,200 @@
+package vm
+
+import "fmt"
+
+type Opcode int
+
+const (
+	OPCODE_ADD Opcode = iota
+	Invoke_function_on_stack_top
+	LoadLocal
+
+	OPCODE_SUB
+	OPCODE_MUL
+	OPCODE_DIV
+	OPCODE_EQ
+	OPCODE_GT
+	OPCODE_LT
+	OPCODE_NEG
+	OPCODE_NOT
+	Pop
+	Push
+	LoadVar
+	Assign
+	StackTopType
+	Blank
+	Return
+	JumpIfFalse
+	Jump
+	SetLocal
+	FieldAccess
+	Halt
+	OPCODE_INDEX
+	OPCODE_SLICE
+	OPCODE_NE
+	OPCODE_GE
+	OPCODE_LE
+	JumpIfFalse_orPop
+	JumpIfTrue_orPop
+	//
+	AccessMemory_andSkipBlanks //post program compile
+	StoreMemory_andSkipBlanks
+)
+
+// max_operands is the most operands any instruction carries.
+const max_operands = 3
+
+// Instruction is one VM operation. Its operands are plain ints whose meaning
+// is fixed per opcode by operand_layouts: a number, an index into the
+// program's names or an index into its constants. Unused operands are 0.
+type Instruction struct {
+	Opcode   Opcode
+	Operands [max_operands]int
+	// origin is one past the offset of the source text the instruction was
+	// compiled or assembled from, so that the zero value means unknown.
+	origin int
+}
+
+// at returns instruction marked as coming from offset in the source.
+func (instruction Instruction) at(offset int) Instruction {
+	instruction.origin = offset + 1
+	return instruction
+}
+
+// mark_origin marks every instruction that has no origin yet as coming from
+// offset, so each instruction keeps the innermost construct it came from.
+func mark_origin(instructions []Instruction, offset int) []Instruction {
+	for i := range instructions {
+		if instructions[i].origin == 0 {
+			instructions[i].origin = offset + 1
+		}
+	}
+	return instructions
+}
+
+type operand_kind byte
+
+const (
+	operand_int operand_kind = iota + 1
+	// operand_name indexes Program.names.
+	operand_name
+	// operand_constant indexes Program.constants.
+	operand_constant
+)
+
+// operand_layouts is the operand kinds each opcode a program may contain
+// carries. Opcodes the VM only creates while running are left out, and so
+// is Blank, which the parser only uses until it knows the operator.
+// OPCODE_SLICE's operand is 1 if an end index was given and 0 if the slice
+// runs to the end of the string. JumpIfFalse always pops the bool it tests;
+// JumpIfFalse_orPop and JumpIfTrue_orPop, which && and || are made of, leave
+// it in place when they jump and pop it otherwise.
+var operand_layouts = map[Opcode][]operand_kind{
+	OPCODE_ADD:                   {},
+	OPCODE_SUB:                   {},
+	OPCODE_MUL:                   {},
+	OPCODE_DIV:                   {},
+	OPCODE_EQ:                    {},
+	OPCODE_GT:                    {},
+	OPCODE_LT:                    {},
+	OPCODE_NEG:                   {},
+	OPCODE_NOT:                   {},
+	OPCODE_INDEX:                 {},
+	OPCODE_NE:                    {},
+	OPCODE_GE:                    {},
+	OPCODE_LE:                    {},
+	OPCODE_SLICE:                 {operand_int},
+	Invoke_function_on_stack_top: {operand_int},
+	LoadLocal:                    {operand_int, operand_name},
+	SetLocal:                     {operand_int, operand_name},
+	Pop:                          {},
+	Push:                         {operand_constant},
+	LoadVar:                      {operand_name},
+	Assign:                       {operand_name},
+	FieldAccess:                  {operand_name},
+	Return:                       {},
+	JumpIfFalse:                  {operand_int},
+	Jump:                         {operand_int},
+	JumpIfFalse_orPop:            {operand_int},
+	JumpIfTrue_orPop:             {operand_int},
+	Halt:                         {},
+}
+
+// opcode_names is the mnemonic each opcode goes by in listings and in
+// assembly source.
+var opcode_names = map[Opcode]string{
+	Pop:                          "POP",
+	Push:                         "PUSH",
+	LoadVar:                      "LOADVAR",
+	Assign:                       "ASSIGN",
+	StackTopType:                 "STACKTOPTYPE",
+	Blank:                        "BLANK",
+	OPCODE_ADD:                   "ADD",
+	OPCODE_SUB:                   "SUB",
+	OPCODE_MUL:                   "MUL",
+	OPCODE_DIV:                   "DIV",
+	OPCODE_EQ:                    "EQ",
+	Invoke_function_on_stack_top: "INVOKE_FUNCTION_ON_STACK_TOP",
+	Return:                       "RETURN",
+	JumpIfFalse:                  "JUMP_IF_FALSE",
+	Jump:                         "JUMP",
+	LoadLocal:                    "LOAD_LOCAL",
+	SetLocal:                     "SET_LOCAL",
+	OPCODE_GT:                    "GT",
+	OPCODE_LT:                    "LT",
+	OPCODE_NEG:                   "NEG",
+	OPCODE_NOT:                   "NOT",
+	OPCODE_INDEX:                 "INDEX",
+	OPCODE_NE:                    "NE",
+	OPCODE_GE:                    "GE",
+	OPCODE_LE:                    "LE",
+	JumpIfFalse_orPop:            "JUMP_IF_FALSE_OR_POP",
+	JumpIfTrue_orPop:             "JUMP_IF_TRUE_OR_POP",
+	OPCODE_SLICE:                 "SLICE",
+	FieldAccess:                  "FIELD_ACCESS",
+	Halt:                         "HALT",
+	AccessMemory_andSkipBlanks:   "ACCESS_MEMORY_AND_SKIP_BLANKS",
+	StoreMemory_andSkipBlanks:    "STORE_MEMORY_AND_SKIP_BLANKS",
+}
+
+// String prints the raw operands; Program.format resolves names and
+// constants.
+func (this Instruction) String() string {
+	res, ok := opcode_names[this.Opcode]
+	if !ok {
+		panic(fmt.Sprintf("Unknown opcode: %d", this.Opcode))
+	}
+	for _, operand := range this.Operands[:operand_count(this.Opcode)] {
+		res += " " + fmt.Sprint(operand)
+	}
+	return res
+
+}
+
+func operand_count(opcode Opcode) int {
+	layout, ok := operand_layouts[opcode]
+	if !ok {
+		return max_operands
+	}
+	return len(layout)
+}
+
+func (Instruction) InstructionOrAstNode__() {}
+
+/////ast
+
+func (astVarRef) InstructionOrAstNode__()    {}
+func (astFieldAccess) InstructionOrAstNode() {}
+
+type astVarRef struct {
+	name string
+}
+type astFieldAccess struct {
+	name string
+}
+
+type InstructionOrAstNode interface {
+	InstructionOrAstNode__()
+}
+
+/////ast
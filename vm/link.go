@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"no-ast/diagnostics"
+)
+
+// link resolves every global variable read and write in
+// program.Instructions, including any field accesses chained onto it, to a
+// direct memory access and stores the result in program.code for the VM to
+// run. program.Instructions itself is left as written so it can still be
+// saved and disassembled.
+//
+// A LoadVar or Assign and its FieldAccess chain become one
+// AccessMemory_andSkipBlanks or StoreMemory_andSkipBlanks followed by the
+// now dead FieldAccess instructions it jumps over, which keeps every jump
+// target valid.
+//
+// References to variables or fields that do not exist, and reads or writes
+// of a whole object, are reported as a diagnostics.List.
+func (program *Program) link() error {
+	code := slices.Clone(program.Instructions)
+	var errors diagnostics.List
+	for i := 0; i < len(code); i++ {
+		switch code[i].Opcode {
+		case LoadVar:
+			mem_offset, type_, next := program.resolve_path(code, i, &errors)
+			// a cell holds one value, so a whole object cannot be read
+			if type_ != "" && !is_primitive(type_) && type_ != "function" && type_ != "builtin-function" {
+				errors = append(errors, program.diagnostic(i, fmt.Sprintf("cannot use %s of type %s as a value", program.path_name(code, i, next), type_)))
+			}
+			code[i] = Instruction{Opcode: AccessMemory_andSkipBlanks, Operands: [max_operands]int{mem_offset, program.name(type_), next}}
+			i = next - 1
+		case Assign:
+			mem_offset, type_, next := program.resolve_path(code, i, &errors)
+			if type_ != "" && !is_primitive(type_) {
+				errors = append(errors, program.diagnostic(i, fmt.Sprintf("cannot assign to %s of type %s", program.path_name(code, i, next), type_)))
+			}
+			code[i] = Instruction{Opcode: StoreMemory_andSkipBlanks, Operands: [max_operands]int{mem_offset, program.name(type_), next}}
+			i = next - 1
+		case FieldAccess:
+			errors = append(errors, program.diagnostic(i, fmt.Sprintf("field %s can only be reached through a variable", program.names[code[i].Operands[0]])))
+		}
+	}
+	if len(errors) > 0 {
+		errors.Sort()
+		return errors
+	}
+	program.code = code
+	return nil
+}
+
+// resolve_path works out where the global named by code[i] and the
+// FieldAccess chain after it lives. It returns the memory offset and type
+// the chain ends at, or an empty type if it could not be resolved, and the
+// index of the first instruction past the chain.
+func (program *Program) resolve_path(code []Instruction, i int, errors *diagnostics.List) (int, string, int) {
+	name := program.names[code[i].Operands[0]]
+	v, ok := program.vars[name]
+	failed := !ok
+	if failed {
+		*errors = append(*errors, program.diagnostic(i, fmt.Sprintf("unknown variable %s", name)))
+	}
+	mem_offset, type_ := v.mem_offset, v.Type
+	next := i + 1
+	for ; next < len(code) && code[next].Opcode == FieldAccess; next++ {
+		if failed {
+			continue
+		}
+		field := program.names[code[next].Operands[0]]
+		class, ok := program.vars[type_]
+		if !ok || class.Type != "class" {
+			*errors = append(*errors, program.diagnostic(next, fmt.Sprintf("%s has no field %s: %s is not a class", program.path_name(code, i, next), field, type_)))
+			failed = true
+			continue
+		}
+		info, ok := program.memory[class.mem_offset].(Class).fieldsInfo[field]
+		if !ok {
+			*errors = append(*errors, program.diagnostic(next, fmt.Sprintf("%s has no field %s", type_, field)))
+			failed = true
+			continue
+		}
+		mem_offset += info.mem_offset
+		type_ = info.Type
+	}
+	if failed {
+		return 0, "", next
+	}
+	return mem_offset, type_, next
+}
+
+// path_name spells out the variable and fields code[start:end] refer to,
+// e.g. person.address.number.
+func (program *Program) path_name(code []Instruction, start int, end int) string {
+	parts := make([]string, 0, end-start)
+	for _, instruction := range code[start:end] {
+		parts = append(parts, program.names[instruction.Operands[0]])
+	}
+	return strings.Join(parts, ".")
+}
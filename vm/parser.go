@@ -0,0 +1,981 @@
+package vm
+
+import (
+	"fmt"
+	"maps"
+	"no-ast/diagnostics"
+	"no-ast/tokenizer"
+	"no-ast/utils/assert"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type Parser struct {
+	source string
+	tokens []tokenizer.Token
+	index  int
+	loops  []Loop
+	// block_depth counts the braced blocks currently open.
+	block_depth int
+	errors      diagnostics.List
+	// program receives the globals, classes and functions being declared.
+	program                  *Program
+	current_parsing_function Function
+	in_function              bool
+	// locals are the current function's parameters followed by the locals
+	// in scope, innermost last; scopes holds len(locals) at the start of
+	// each block that is open in it.
+	locals []VarInfo
+	scopes []int
+}
+
+// Loop tracks the while loop currently being parsed. Continues can jump
+// straight to start_index, but breaks are emitted with an empty operand and
+// patched once the end of the loop is known. Both first pop the locals
+// declared inside the loop, which sit above its first local_slots slots.
+type Loop struct {
+	start_index         int
+	pending_break_jumps []int
+	local_slots         int
+}
+
+// in_range reports whether there are tokens left before the trailing EOF.
+func (p *Parser) in_range() bool {
+	return p.index < len(p.tokens) && p.tokens[p.index].Type != tokenizer.TOKEN_EOF
+}
+
+// fail aborts parsing with a diagnostic pointing at t; block_instructions
+// recovers it and hands it back as an error.
+func (p *Parser) fail(t tokenizer.Token, format string, args ...any) {
+	panic(diagnostics.At(p.source, t.Offset, t.Line, t.Column, fmt.Sprintf(format, args...)))
+}
+
+func (p *Parser) cur_token() tokenizer.Token {
+	return p.tokens[p.index]
+}
+
+func (p *Parser) parse_wrapped_term(previous_instruction_amount int) []Instruction {
+	if p.in_range() && p.cur_token().Value == "(" {
+		p.index++
+		instructions := p.parse_expression(previous_instruction_amount)
+		p.expect_token(")")
+		return instructions
+	}
+	if p.in_range() && p.cur_token().Type == tokenizer.TOKEN_OPERATOR {
+		operator := p.cur_token()
+		switch operator.Value {
+		case "-":
+			p.index++
+			return append(p.parse_wrapped_term(previous_instruction_amount), Instruction{Opcode: OPCODE_NEG}.at(operator.Offset))
+		case "!":
+			p.index++
+			return append(p.parse_wrapped_term(previous_instruction_amount), Instruction{Opcode: OPCODE_NOT}.at(operator.Offset))
+		}
+	}
+	term_start := p.index
+	exp_byte_code := p.parse_term().at(p.tokens[term_start].Offset)
+	was_ident := exp_byte_code.Opcode != Push
+	if !was_ident {
+		return []Instruction{exp_byte_code}
+	}
+	// fmt.Print(p.cur_token().Value, "p.tokens[p.index].Value")
+	instructions := []Instruction{exp_byte_code}
+	for p.in_range() {
+		state_changed := false
+		if p.cur_token().Value == "(" {
+			call_token := p.NextToken()
+			callee := p.called_builtin(instructions)
+			arg_count := 0
+			arg_types := []string{}
+			for p.in_range() && p.cur_token().Value != ")" {
+				arg := p.parse_expression(previous_instruction_amount + len(instructions))
+				instructions = append(instructions, arg...)
+				arg_types = append(arg_types, p.static_type(arg))
+				arg_count++
+				if p.cur_token().Value == "," {
+					p.index++
+				} else {
+					break
+				}
+			}
+			p.expect_token(")")
+			if callee != nil {
+				if problem := callee.check_arguments(arg_types); problem != "" {
+					p.fail(call_token, "%s", problem)
+				}
+			}
+			instructions = append(instructions, Instruction{Opcode: Invoke_function_on_stack_top, Operands: [max_operands]int{arg_count}}.at(call_token.Offset))
+			state_changed = true
+		}
+		if p.cur_token().Value == "." {
+			p.index++
+			field := p.NextToken()
+			if field.Type != tokenizer.TOKEN_IDENTIFIER {
+				p.fail(field, "Expected field name, got %s", field)
+			}
+			if len(instructions) == 1 && instructions[0].Opcode == LoadLocal {
+				// a local's fields sit in the slots after it, so reading one
+				// is just a LoadLocal further along
+				v := p.local_field(VarInfo{Type: p.program.names[instructions[0].Operands[1]], mem_offset: instructions[0].Operands[0]}, field)
+				instructions[0] = Instruction{Opcode: LoadLocal, Operands: [max_operands]int{v.mem_offset, p.program.name(v.Type)}}.at(p.tokens[term_start].Offset)
+			} else {
+				instructions = append(instructions, Instruction{Opcode: FieldAccess, Operands: [max_operands]int{p.program.name(field.Value)}}.at(field.Offset))
+			}
+			state_changed = true
+		}
+		if p.cur_token().Value == "[" {
+			bracket := p.NextToken()
+			index := p.parse_index(previous_instruction_amount + len(instructions))
+			instructions = append(instructions, mark_origin(index, bracket.Offset)...)
+			state_changed = true
+		}
+		if !state_changed {
+			break
+		}
+	}
+	// a local object spans several slots, so only its fields are values
+	if instructions[0].Opcode == LoadLocal {
+		if type_ := p.program.names[instructions[0].Operands[1]]; !is_primitive(type_) {
+			p.fail(p.tokens[term_start], "cannot use %s of type %s as a value", p.local_path(term_start), type_)
+		}
+	}
+	return instructions
+}
+
+// local_path spells out the local and the fields read from it starting at
+// token start, e.g. person.address.
+func (p *Parser) local_path(start int) string {
+	path := p.tokens[start].Value
+	for i := start + 1; i+1 < p.index && p.tokens[i].Value == "."; i += 2 {
+		path += "." + p.tokens[i+1].Value
+	}
+	return path
+}
+
+// parse_index parses the rest of s[i], s[i:j], s[i:] or s[:j] after the
+// opening bracket. A missing start index is 0.
+func (p *Parser) parse_index(previous_instruction_amount int) []Instruction {
+	instructions := []Instruction{}
+	if p.cur_token().Value == ":" {
+		instructions = append(instructions, Instruction{Opcode: Push, Operands: [max_operands]int{p.program.constant(TypeSafeValue{Type: "int", Data: 0})}})
+	} else {
+		instructions = p.parse_expression(previous_instruction_amount)
+		if p.cur_token().Value != ":" {
+			p.expect_token("]")
+			return append(instructions, Instruction{Opcode: OPCODE_INDEX})
+		}
+	}
+	p.expect_token(":")
+	has_end := 0
+	if p.cur_token().Value != "]" {
+		instructions = append(instructions, p.parse_expression(previous_instruction_amount+len(instructions))...)
+		has_end = 1
+	}
+	p.expect_token("]")
+	return append(instructions, Instruction{Opcode: OPCODE_SLICE, Operands: [max_operands]int{has_end}})
+}
+
+// called_builtin returns the builtin that callee_instructions load, if they
+// are nothing but a plain reference to one.
+func (p *Parser) called_builtin(callee_instructions []Instruction) *builtin {
+	if len(callee_instructions) != 1 || callee_instructions[0].Opcode != LoadVar {
+		return nil
+	}
+	b, _ := p.program.lookup_builtin(p.program.names[callee_instructions[0].Operands[0]])
+	return b
+}
+
+// static_type returns the type an expression is known to produce without
+// running it, or "" when that takes more than looking at its last operation,
+// a literal, a variable and its fields, or a call to something declared
+// already.
+func (p *Parser) static_type(expression []Instruction) string {
+	if len(expression) == 0 {
+		return ""
+	}
+	// a && b and a || b end with b, straight after the jump that skips it
+	if start := operand_start(expression, len(expression)); start > 0 && is_short_circuit(expression[start-1].Opcode) {
+		return "bool"
+	}
+	switch expression[len(expression)-1].Opcode {
+	case OPCODE_ADD, OPCODE_SUB, OPCODE_MUL, OPCODE_DIV:
+		right_start := operand_start(expression, len(expression)-1)
+		return arithmetic_type(p.static_type(expression[:right_start]), p.static_type(expression[right_start:len(expression)-1]))
+	case OPCODE_NEG:
+		if p.static_type(expression[:len(expression)-1]) == "float" {
+			return "float"
+		}
+		return "int"
+	case OPCODE_INDEX, OPCODE_SLICE:
+		return "string"
+	case OPCODE_EQ, OPCODE_NE, OPCODE_GT, OPCODE_GE, OPCODE_LT, OPCODE_LE, OPCODE_NOT:
+		return "bool"
+	case Invoke_function_on_stack_top:
+		// arguments are emitted between the callee and the call, so the
+		// outermost callee is the first instruction
+		if expression[0].Opcode != LoadVar {
+			return ""
+		}
+		v := p.program.vars[p.program.names[expression[0].Operands[0]]]
+		switch v.Type {
+		case "builtin-function":
+			return p.program.memory[v.mem_offset].(*builtin).return_type
+		case "function":
+			return p.program.memory[v.mem_offset].(Function).return_type
+		}
+		return ""
+	}
+	switch expression[0].Opcode {
+	case Push:
+		if len(expression) == 1 {
+			return p.program.constants[expression[0].Operands[0]].Type
+		}
+	case LoadLocal:
+		if len(expression) == 1 {
+			return p.program.names[expression[0].Operands[1]]
+		}
+	case LoadVar:
+		v, ok := p.program.vars[p.program.names[expression[0].Operands[0]]]
+		if !ok || !p.program.is_data_type(v.Type) {
+			return ""
+		}
+		type_ := v.Type
+		for _, instruction := range expression[1:] {
+			if instruction.Opcode != FieldAccess || !p.program.is_data_type(type_) || is_primitive(type_) {
+				return ""
+			}
+			field, ok := p.program.lookup_class(type_).fieldsInfo[p.program.names[instruction.Operands[0]]]
+			if !ok {
+				return ""
+			}
+			type_ = field.Type
+		}
+		return type_
+	}
+	return ""
+}
+
+// arithmetic_type is the type of left + right (or -, *, /) given what is
+// known of the operand types: float if either side is one, string for
+// joined strings and otherwise int.
+func arithmetic_type(left string, right string) string {
+	switch {
+	case left == "float" || right == "float":
+		return "float"
+	case left == "string" || right == "string":
+		return "string"
+	case left == "" && right == "":
+		return ""
+	}
+	return "int"
+}
+
+// operand_start returns where the instructions computing the value that
+// expression[end-1] leaves on the stack begin.
+func operand_start(expression []Instruction, end int) int {
+	needed := 1
+	for i := end - 1; i > 0; i-- {
+		// every instruction an expression is made of pushes one value,
+		// except the jumps of && and ||, which pop one on the way to their
+		// right-hand side
+		pushed := 1
+		if is_short_circuit(expression[i].Opcode) {
+			pushed = 0
+		}
+		needed += operands_popped(expression[i]) - pushed
+		if needed == 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+func is_short_circuit(opcode Opcode) bool {
+	return opcode == JumpIfFalse_orPop || opcode == JumpIfTrue_orPop
+}
+
+func (p *Parser) expect_token(token_value string) {
+	if t := p.NextToken(); t.Value != token_value {
+		p.fail(t, "Expected token %s, got %s", token_value, t)
+	}
+}
+
+func (p *Parser) parse_term() Instruction {
+	t := p.NextToken()
+	switch t.Type {
+	case tokenizer.TOKEN_NUMBER:
+		if strings.ContainsAny(t.Value, ".eE") {
+			f, err := strconv.ParseFloat(t.Value, 64)
+			if err != nil {
+				p.fail(t, "float %s is out of range", t.Value)
+			}
+			return Instruction{Opcode: Push, Operands: [max_operands]int{p.program.constant(TypeSafeValue{Type: "float", Data: f})}}
+		}
+		n, err := strconv.Atoi(t.Value)
+		if err != nil {
+			p.fail(t, "integer %s is out of range", t.Value)
+		}
+		return Instruction{Opcode: Push, Operands: [max_operands]int{p.program.constant(TypeSafeValue{Type: "int", Data: n})}} // Instruction{Opcode: StackTopType, Operands: []any{"int"}}
+
+	case tokenizer.TOKEN_STRING:
+		return Instruction{Opcode: Push, Operands: [max_operands]int{p.program.constant(TypeSafeValue{Type: "string", Data: t.Value})}} //  Instruction{Opcode: StackTopType, Operands: []any{"string"}}
+
+	case tokenizer.TOKEN_IDENTIFIER:
+		if t.Value == "true" || t.Value == "false" {
+			return Instruction{Opcode: Push, Operands: [max_operands]int{p.program.constant(TypeSafeValue{Type: "bool", Data: t.Value == "true"})}}
+		}
+		if v, ok := p.lookup_local(t.Value); ok {
+			return Instruction{Opcode: LoadLocal, Operands: [max_operands]int{
+				v.mem_offset, p.program.name(v.Type),
+			}}
+		}
+		return Instruction{Opcode: LoadVar, Operands: [max_operands]int{p.program.name(t.Value)}}
+	default:
+		p.fail(t, "Unexpected token: %s", t)
+		return Instruction{}
+	}
+
+}
+
+// operator_precedence returns how tightly a binary operator binds; higher
+// numbers bind tighter and 0 means t is not a binary operator.
+func operator_precedence(t tokenizer.Token) int {
+	switch t.Value {
+	case "||":
+		return 1
+	case "&&":
+		return 2
+	case "==", "!=", ">", ">=", "<", "<=":
+		return 3
+	case "+", "-":
+		return 4
+	case "*", "/":
+		return 5
+	default:
+		return 0
+	}
+}
+
+// parse_expression parses an expression whose instructions will start at
+// previous_instruction_amount, which && and || need to aim their jumps.
+func (p *Parser) parse_expression(previous_instruction_amount int) []Instruction {
+	return p.parse_binary_expression(1, previous_instruction_amount)
+}
+
+// parse_binary_expression is a precedence climber: it only consumes
+// operators binding at least as tightly as min_precedence, and parses each
+// right-hand side one level tighter so equal-precedence chains associate to
+// the left.
+//
+// && and || short-circuit: the left side's bool is left on the stack as the
+// result when it decides the outcome, and the right side is jumped over.
+func (p *Parser) parse_binary_expression(min_precedence int, previous_instruction_amount int) []Instruction {
+	instructions := p.parse_wrapped_term(previous_instruction_amount)
+	for p.in_range() && p.tokens[p.index].Type == tokenizer.TOKEN_OPERATOR {
+		precedence := operator_precedence(p.cur_token())
+		if precedence == 0 {
+			p.fail(p.cur_token(), "Unexpected operator: %s", p.cur_token())
+		}
+		if precedence < min_precedence {
+			break
+		}
+		t := p.NextToken()
+		if t.Value == "&&" || t.Value == "||" {
+			jump := Instruction{Opcode: JumpIfFalse_orPop}.at(t.Offset)
+			if t.Value == "||" {
+				jump.Opcode = JumpIfTrue_orPop
+			}
+			instructions = append(instructions, jump)
+			jump_index := len(instructions) - 1
+			instructions = append(instructions, p.parse_binary_expression(precedence+1, previous_instruction_amount+len(instructions))...)
+			instructions[jump_index].Operands[0] = previous_instruction_amount + len(instructions)
+			continue
+		}
+		operation_byte_code := Instruction{Opcode: Blank}
+		switch t.Value {
+		case "+":
+			operation_byte_code = Instruction{Opcode: OPCODE_ADD}
+		case "-":
+			operation_byte_code = Instruction{Opcode: OPCODE_SUB}
+		case "*":
+			operation_byte_code = Instruction{Opcode: OPCODE_MUL}
+		case "==":
+			operation_byte_code = Instruction{Opcode: OPCODE_EQ}
+		case "!=":
+			operation_byte_code = Instruction{Opcode: OPCODE_NE}
+		case "/":
+			operation_byte_code = Instruction{Opcode: OPCODE_DIV}
+		case ">":
+			operation_byte_code = Instruction{Opcode: OPCODE_GT}
+		case ">=":
+			operation_byte_code = Instruction{Opcode: OPCODE_GE}
+		case "<":
+			operation_byte_code = Instruction{Opcode: OPCODE_LT}
+		case "<=":
+			operation_byte_code = Instruction{Opcode: OPCODE_LE}
+		default:
+			p.fail(t, "Unexpected operator: %s", t)
+		}
+		right := p.parse_binary_expression(precedence+1, previous_instruction_amount+len(instructions))
+		instructions = append(instructions, right...)
+		instructions = append(instructions, operation_byte_code.at(t.Offset))
+	}
+	return instructions
+}
+
+// parse_statement parses one statement. returns reports whether every path
+// through the statement ends in a return, after which nothing in the block
+// runs: a return itself, or an if whose branches, including an else, all
+// return.
+func (p *Parser) parse_statement(previous_instruction_amount int) (instructions []Instruction, returns bool) {
+	t := p.NextToken()
+	if t.Value == "return" {
+		return append(p.parse_return_value(previous_instruction_amount), Instruction{Opcode: Return}), true
+	}
+	if t.Value == "fn" {
+		return p.parse_function_declaration(previous_instruction_amount), false
+	}
+	if t.Value == "class" {
+		p.parse_class_declaration()
+		return nil, false
+	}
+	if t.Value == "var" {
+		return p.parse_var_declaration(), false
+	}
+	if t.Value == "let" {
+		return p.parse_let_declaration(previous_instruction_amount), false
+	}
+	if t.Value == "if" {
+		return p.parse_if_statement(previous_instruction_amount)
+	}
+	if t.Value == "while" {
+		start_index := len(instructions)
+		enclosing_loop_count := len(p.loops)
+		p.loops = append(p.loops, Loop{start_index: previous_instruction_amount + start_index, local_slots: p.next_local_slot()})
+		defer func() { p.loops = p.loops[:enclosing_loop_count] }()
+		instructions = append(instructions, p.parse_expression(previous_instruction_amount+len(instructions))...)
+		instructions = append(instructions, Instruction{Opcode: JumpIfFalse})
+		conditional_jump_instruction_index := len(instructions) - 1
+		body, _ := p.parse_braced_block(previous_instruction_amount + len(instructions))
+		instructions = append(instructions, body...)
+		instructions = append(instructions, Instruction{Opcode: Jump, Operands: [max_operands]int{previous_instruction_amount + start_index}})
+		assert.Assert(instructions[conditional_jump_instruction_index].Opcode == JumpIfFalse)
+		instructions[conditional_jump_instruction_index] = Instruction{Opcode: JumpIfFalse, Operands: [max_operands]int{previous_instruction_amount + len(instructions)}}
+		loop := p.loops[len(p.loops)-1]
+		for _, break_index := range loop.pending_break_jumps {
+			assert.Assert(instructions[break_index-previous_instruction_amount].Opcode == Jump)
+			instructions[break_index-previous_instruction_amount] = Instruction{Opcode: Jump, Operands: [max_operands]int{previous_instruction_amount + len(instructions)}}
+		}
+		return instructions, false
+	}
+	if t.Value == "break" {
+		if len(p.loops) == 0 {
+			p.fail(t, "break outside of a loop")
+		}
+		loop := &p.loops[len(p.loops)-1]
+		instructions = p.pop_locals(loop.local_slots)
+		loop.pending_break_jumps = append(loop.pending_break_jumps, previous_instruction_amount+len(instructions))
+		return append(instructions, Instruction{Opcode: Jump}), false
+	}
+	if t.Value == "continue" {
+		if len(p.loops) == 0 {
+			p.fail(t, "continue outside of a loop")
+		}
+		loop := p.loops[len(p.loops)-1]
+		instructions = p.pop_locals(loop.local_slots)
+		return append(instructions, Instruction{Opcode: Jump, Operands: [max_operands]int{loop.start_index}}), false
+	}
+	if p.in_range() && (p.cur_token().Value == "=" || p.cur_token().Value == ".") {
+		return append(instructions, p.parse_assignment(t, previous_instruction_amount)...), false
+	}
+	if p.in_range() && p.cur_token().Value == "(" {
+		p.index--
+		instructions = append(instructions, p.parse_wrapped_term(previous_instruction_amount+len(instructions))...)
+		return append(instructions, Instruction{Opcode: Pop}), false
+	}
+	p.fail(t, "Unexpected statement: %s", t)
+	return nil, false
+
+}
+
+// parse_if_statement parses the rest of an `if cond { ... }` along with any
+// `else if` / `else` chain. Every branch that runs ends with a Jump past the
+// whole chain; `else if` recurses so each link patches its own jumps.
+// returns reports whether every branch returns, which needs an else.
+func (p *Parser) parse_if_statement(previous_instruction_amount int) (instructions []Instruction, returns bool) {
+	instructions = p.parse_expression(previous_instruction_amount)
+	instructions = append(instructions, Instruction{Opcode: JumpIfFalse})
+	conditional_jump_instruction_index := len(instructions) - 1
+	then_block, then_returns := p.parse_braced_block(previous_instruction_amount + len(instructions))
+	instructions = append(instructions, then_block...)
+	if !p.in_range() || p.cur_token().Value != "else" {
+		instructions[conditional_jump_instruction_index] = Instruction{Opcode: JumpIfFalse, Operands: [max_operands]int{previous_instruction_amount + len(instructions)}}
+		return instructions, false
+	}
+	p.index++
+	instructions = append(instructions, Instruction{Opcode: Jump})
+	end_jump_instruction_index := len(instructions) - 1
+	instructions[conditional_jump_instruction_index] = Instruction{Opcode: JumpIfFalse, Operands: [max_operands]int{previous_instruction_amount + len(instructions)}}
+	var else_block []Instruction
+	var else_returns bool
+	if p.in_range() && p.cur_token().Value == "if" {
+		p.index++
+		else_block, else_returns = p.parse_if_statement(previous_instruction_amount + len(instructions))
+	} else {
+		else_block, else_returns = p.parse_braced_block(previous_instruction_amount + len(instructions))
+	}
+	instructions = append(instructions, else_block...)
+	assert.Assert(instructions[end_jump_instruction_index].Opcode == Jump)
+	instructions[end_jump_instruction_index] = Instruction{Opcode: Jump, Operands: [max_operands]int{previous_instruction_amount + len(instructions)}}
+	return instructions, then_returns && else_returns
+}
+
+// parse_assignment parses `name = expr` or `name.field.field = expr` once
+// name has been read. Locals are resolved to their slot here; globals are
+// left to link, just like reads.
+func (p *Parser) parse_assignment(name tokenizer.Token, previous_instruction_amount int) []Instruction {
+	var fields []tokenizer.Token
+	for p.cur_token().Value == "." {
+		p.index++
+		field := p.NextToken()
+		if field.Type != tokenizer.TOKEN_IDENTIFIER {
+			p.fail(field, "Expected field name, got %s", field)
+		}
+		fields = append(fields, field)
+	}
+	p.expect_token("=")
+	v, is_local := p.lookup_local(name.Value)
+	if _, ok := p.program.vars[name.Value]; !ok && !is_local {
+		p.fail(name, "%s is not declared; declare it with var %s <type> or let %s = <value>", name.Value, name.Value, name.Value)
+	}
+	instructions := p.parse_expression(previous_instruction_amount)
+	if is_local {
+		for _, field := range fields {
+			v = p.local_field(v, field)
+		}
+		if !is_primitive(v.Type) {
+			p.fail(name, "cannot assign to %s of type %s", v.Name, v.Type)
+		}
+		return append(instructions, Instruction{Opcode: SetLocal, Operands: [max_operands]int{
+			v.mem_offset, p.program.name(v.Type),
+		}})
+	}
+	instructions = append(instructions, Instruction{Opcode: Assign, Operands: [max_operands]int{p.program.name(name.Value)}})
+	for _, field := range fields {
+		instructions = append(instructions, Instruction{Opcode: FieldAccess, Operands: [max_operands]int{p.program.name(field.Value)}}.at(field.Offset))
+	}
+	return instructions
+}
+
+// local_field returns the slot and type of field within the local v. A
+// local's fields are laid out in consecutive slots the same way a global's
+// are laid out in memory cells.
+func (p *Parser) local_field(v VarInfo, field tokenizer.Token) VarInfo {
+	if class, ok := p.program.vars[v.Type]; !ok || class.Type != "class" {
+		p.fail(field, "%s is not a class and has no field %s", v.Type, field.Value)
+	}
+	info, ok := p.program.lookup_class(v.Type).fieldsInfo[field.Value]
+	if !ok {
+		p.fail(field, "%s has no field %s", v.Type, field.Value)
+	}
+	return VarInfo{Name: v.Name + "." + field.Value, Type: info.Type, mem_offset: v.mem_offset + info.mem_offset}
+}
+
+// parse_function_declaration parses `fn name(a int, b string) int { ... }`
+// after the fn keyword. The body is emitted inline behind a jump that skips
+// it, and the Function header is registered in vars/memory at compile time.
+func (p *Parser) parse_function_declaration(previous_instruction_amount int) []Instruction {
+	if p.in_function {
+		p.fail(p.tokens[p.index-1], "nested function declarations are not supported")
+	}
+	name := p.NextToken()
+	if name.Type != tokenizer.TOKEN_IDENTIFIER {
+		p.fail(name, "Expected function name, got %s", name)
+	}
+	if _, ok := p.program.vars[name.Value]; ok {
+		p.fail(name, "%s is already declared", name.Value)
+	}
+	function := Function{Name: name.Value, return_type: "void", local_vars: map[string]VarInfo{}}
+	params := []VarInfo{}
+	p.expect_token("(")
+	for p.in_range() && p.cur_token().Value != ")" {
+		param_name := p.NextToken()
+		param_type := p.NextToken()
+		if param_name.Type != tokenizer.TOKEN_IDENTIFIER || param_type.Type != tokenizer.TOKEN_IDENTIFIER {
+			p.fail(param_name, "Expected parameter name and type, got %s %s", param_name, param_type)
+		}
+		if _, ok := function.local_vars[param_name.Value]; ok {
+			p.fail(param_name, "duplicate parameter %s in %s", param_name.Value, name.Value)
+		}
+		// a parameter gets a single slot, which only holds a primitive
+		if !is_primitive(param_type.Value) {
+			p.fail(param_type, "parameter %s must be an int, a float, a bool or a string, got %s", param_name.Value, param_type.Value)
+		}
+		param := VarInfo{Name: param_name.Value, Type: param_type.Value, mem_offset: len(function.param_types)}
+		function.local_vars[param_name.Value] = param
+		params = append(params, param)
+		function.param_types = append(function.param_types, param_type.Value)
+		if p.cur_token().Value != "," {
+			break
+		}
+		p.index++
+	}
+	p.expect_token(")")
+	if p.in_range() && p.cur_token().Type == tokenizer.TOKEN_IDENTIFIER {
+		return_type := p.NextToken()
+		// the result comes back in a single slot as well
+		if !is_primitive(return_type.Value) {
+			p.fail(return_type, "function %s must return an int, a float, a bool or a string, got %s", name.Value, return_type.Value)
+		}
+		function.return_type = return_type.Value
+	}
+
+	instructions := []Instruction{{Opcode: Jump}}
+	skip_jump_index := len(instructions) - 1
+	function.instruction_start_index = previous_instruction_amount + len(instructions)
+	p.program.memory[p.program.allocate_global(name.Value, "function").mem_offset] = function
+
+	p.current_parsing_function = function
+	p.in_function = true
+	p.locals = params
+	// a function may be declared inside a top-level block or loop, whose
+	// scopes and loops it must neither see nor lose
+	enclosing_loops, enclosing_scopes := p.loops, p.scopes
+	p.loops, p.scopes = nil, nil
+	defer func() {
+		p.loops, p.scopes = enclosing_loops, enclosing_scopes
+		p.current_parsing_function = Function{}
+		p.in_function = false
+		p.locals = nil
+	}()
+	body, returns := p.parse_braced_block(previous_instruction_amount + len(instructions))
+	instructions = append(instructions, body...)
+
+	// a void function may fall off the end on any path, so it always gets
+	// the implicit return; any other function has to return on every path
+	if function.return_type == "void" {
+		instructions = append(instructions, Instruction{Opcode: Push, Operands: [max_operands]int{p.program.constant(void_value)}})
+		instructions = append(instructions, Instruction{Opcode: Return})
+	} else if !returns {
+		// the declaration itself parsed fine, so report without unwinding
+		end := p.tokens[p.index-1]
+		p.errors = append(p.errors, diagnostics.At(p.source, end.Offset, end.Line, end.Column,
+			fmt.Sprintf("function %s must return a value of type %s on every path", name.Value, function.return_type)))
+	}
+	instructions[skip_jump_index] = Instruction{Opcode: Jump, Operands: [max_operands]int{previous_instruction_amount + len(instructions)}}
+	return instructions
+}
+
+// parse_class_declaration parses `class Person { age int; address Address }`
+// after the class keyword. Fields are laid out in declaration order, so
+// every field type has to be known by the time it is used.
+func (p *Parser) parse_class_declaration() {
+	name := p.NextToken()
+	if name.Type != tokenizer.TOKEN_IDENTIFIER {
+		p.fail(name, "Expected class name, got %s", name)
+	}
+	if _, ok := p.program.vars[name.Value]; ok {
+		p.fail(name, "%s is already declared", name.Value)
+	}
+	class := Class{Name: name.Value, fieldsInfo: map[string]VarInfo{}}
+	size := 0
+	p.expect_token("{")
+	for p.in_range() && p.cur_token().Value != "}" {
+		field_name := p.NextToken()
+		field_type := p.NextToken()
+		if field_name.Type != tokenizer.TOKEN_IDENTIFIER || field_type.Type != tokenizer.TOKEN_IDENTIFIER {
+			p.fail(field_name, "Expected field name and type, got %s %s", field_name, field_type)
+		}
+		if _, ok := class.fieldsInfo[field_name.Value]; ok {
+			p.fail(field_name, "duplicate field %s in %s", field_name.Value, name.Value)
+		}
+		if !p.program.is_data_type(field_type.Value) {
+			p.fail(field_type, "unknown type %s", field_type.Value)
+		}
+		class.fieldsInfo[field_name.Value] = VarInfo{Name: field_name.Value, Type: field_type.Value, mem_offset: size}
+		size += p.program.get_type_size(field_type.Value)
+		if p.cur_token().Value == ";" || p.cur_token().Value == "," {
+			p.index++
+		}
+	}
+	p.expect_token("}")
+	p.program.memory[p.program.allocate_global(name.Value, "class").mem_offset] = class
+}
+
+// parse_var_declaration parses `var name Type`. At top level it reserves
+// zeroed memory for a new global of that type; inside a function it pushes
+// the zero value as a new local.
+func (p *Parser) parse_var_declaration() []Instruction {
+	if !p.in_function && p.block_depth > 0 {
+		p.fail(p.tokens[p.index-1], "globals can only be declared outside of blocks")
+	}
+	name := p.NextToken()
+	type_ := p.NextToken()
+	if name.Type != tokenizer.TOKEN_IDENTIFIER || type_.Type != tokenizer.TOKEN_IDENTIFIER {
+		p.fail(name, "Expected variable name and type, got %s %s", name, type_)
+	}
+	if !p.program.is_data_type(type_.Value) {
+		p.fail(type_, "unknown type %s", type_.Value)
+	}
+	if p.in_function {
+		instructions := p.zero_value(type_.Value)
+		p.declare_local(name, type_.Value)
+		return instructions
+	}
+	if _, ok := p.program.vars[name.Value]; ok {
+		p.fail(name, "%s is already declared", name.Value)
+	}
+	v := p.program.allocate_global(name.Value, type_.Value)
+	p.program.zero_memory(v.mem_offset, v.Type)
+	return nil
+}
+
+// parse_let_declaration parses `let name = expr`, declaring a local, or at
+// top level a global, of whatever type expr is known to produce.
+func (p *Parser) parse_let_declaration(previous_instruction_amount int) []Instruction {
+	if !p.in_function && p.block_depth > 0 {
+		p.fail(p.tokens[p.index-1], "globals can only be declared outside of blocks")
+	}
+	name := p.NextToken()
+	if name.Type != tokenizer.TOKEN_IDENTIFIER {
+		p.fail(name, "Expected variable name, got %s", name)
+	}
+	p.expect_token("=")
+	instructions := p.parse_expression(previous_instruction_amount)
+	type_ := p.static_type(instructions)
+	switch {
+	case type_ == "":
+		p.fail(name, "cannot tell the type of %s; declare it with var %s <type> and assign it instead", name.Value, name.Value)
+	case !is_primitive(type_):
+		p.fail(name, "cannot declare %s as a %s; let only declares int, float, bool and string variables", name.Value, type_)
+	}
+	if !p.in_function {
+		if _, ok := p.program.vars[name.Value]; ok {
+			p.fail(name, "%s is already declared", name.Value)
+		}
+		v := p.program.allocate_global(name.Value, type_)
+		p.program.zero_memory(v.mem_offset, v.Type)
+		return append(instructions, Instruction{Opcode: Assign, Operands: [max_operands]int{p.program.name(name.Value)}})
+	}
+	// the value is left on the stack, exactly where the new local's slot is
+	p.declare_local(name, type_)
+	return instructions
+}
+
+// zero_value pushes the zero value of type_, one slot per memory cell.
+func (p *Parser) zero_value(type_ string) []Instruction {
+	switch type_ {
+	case "int":
+		return []Instruction{{Opcode: Push, Operands: [max_operands]int{p.program.constant(TypeSafeValue{Type: "int", Data: 0})}}}
+	case "float":
+		return []Instruction{{Opcode: Push, Operands: [max_operands]int{p.program.constant(TypeSafeValue{Type: "float", Data: 0.0})}}}
+	case "bool":
+		return []Instruction{{Opcode: Push, Operands: [max_operands]int{p.program.constant(TypeSafeValue{Type: "bool", Data: false})}}}
+	case "string":
+		return []Instruction{{Opcode: Push, Operands: [max_operands]int{p.program.constant(TypeSafeValue{Type: "string", Data: ""})}}}
+	}
+	fields := slices.Collect(maps.Values(p.program.lookup_class(type_).fieldsInfo))
+	slices.SortFunc(fields, func(a, b VarInfo) int { return a.mem_offset - b.mem_offset })
+	instructions := []Instruction{}
+	for _, field := range fields {
+		instructions = append(instructions, p.zero_value(field.Type)...)
+	}
+	return instructions
+}
+
+// lookup_local finds the innermost local or parameter called name.
+func (p *Parser) lookup_local(name string) (VarInfo, bool) {
+	for i := len(p.locals) - 1; i >= 0; i-- {
+		if p.locals[i].Name == name {
+			return p.locals[i], true
+		}
+	}
+	return VarInfo{}, false
+}
+
+// declare_local adds a local of type_ in the slots just pushed. It may
+// shadow a global or a local of an enclosing block, but not another one
+// in the same block; a function body shares its block with the parameters.
+func (p *Parser) declare_local(name tokenizer.Token, type_ string) {
+	scope_start := 0
+	if len(p.scopes) > 1 {
+		scope_start = p.scopes[len(p.scopes)-1]
+	}
+	for _, v := range p.locals[scope_start:] {
+		if v.Name == name.Value {
+			p.fail(name, "%s is already declared in this block", name.Value)
+		}
+	}
+	p.locals = append(p.locals, VarInfo{Name: name.Value, Type: type_, mem_offset: p.next_local_slot()})
+}
+
+// next_local_slot is the slot the next local declared would take, counted
+// from the first parameter.
+func (p *Parser) next_local_slot() int {
+	if len(p.locals) == 0 {
+		return 0
+	}
+	last := p.locals[len(p.locals)-1]
+	return last.mem_offset + p.program.get_type_size(last.Type)
+}
+
+// pop_locals drops every local slot from slot up, for leaving their block.
+func (p *Parser) pop_locals(slot int) []Instruction {
+	instructions := []Instruction{}
+	for range p.next_local_slot() - slot {
+		instructions = append(instructions, Instruction{Opcode: Pop})
+	}
+	return instructions
+}
+
+// parse_return_value emits the value a return statement hands back. Only
+// functions with a non-void return_type take an expression after return;
+// everything else returns void_value so Return can always pop one value.
+func (p *Parser) parse_return_value(previous_instruction_amount int) []Instruction {
+	if !p.in_function || p.current_parsing_function.return_type == "void" {
+		return []Instruction{{Opcode: Push, Operands: [max_operands]int{p.program.constant(void_value)}}}
+	}
+	if !p.in_range() || p.cur_token().Value == "}" || p.cur_token().Type == tokenizer.TOKEN_EOF {
+		p.fail(p.tokens[p.index-1], "function %s must return a %s value", p.current_parsing_function.Name, p.current_parsing_function.return_type)
+	}
+	return p.parse_expression(previous_instruction_amount)
+}
+
+// parse_braced_block parses `{ statements }`, numbering the instructions
+// from previous_instruction_amount. returns reports whether the block's last
+// statement returns on every path.
+func (p *Parser) parse_braced_block(previous_instruction_amount int) (instructions []Instruction, returns bool) {
+	p.expect_token("{")
+	p.block_depth++
+	p.scopes = append(p.scopes, len(p.locals))
+	for p.in_range() && p.cur_token().Value != "}" {
+		var statement []Instruction
+		statement, returns = p.parse_statement_or_recover(previous_instruction_amount + len(instructions))
+		instructions = append(instructions, statement...)
+	}
+	// locals declared in the block go out of scope, unless it returned
+	scope_start := p.scopes[len(p.scopes)-1]
+	p.scopes = p.scopes[:len(p.scopes)-1]
+	if scope_start < len(p.locals) {
+		if !returns {
+			instructions = append(instructions, p.pop_locals(p.locals[scope_start].mem_offset)...)
+		}
+		p.locals = p.locals[:scope_start]
+	}
+	p.block_depth--
+	p.expect_token("}")
+	return instructions, returns
+}
+
+// parse_statement_or_recover parses one statement. If it fails, the
+// diagnostic is recorded, the parser skips ahead to the next statement
+// boundary and the statement contributes no instructions, so compilation
+// carries on and later errors are reported too.
+func (p *Parser) parse_statement_or_recover(previous_instruction_amount int) (instructions []Instruction, returns bool) {
+	start_index := p.index
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		diagnostic, ok := r.(diagnostics.Error)
+		if !ok {
+			panic(r)
+		}
+		p.errors = append(p.errors, diagnostic)
+		// breaks recorded by the abandoned statement point at instructions
+		// that are being thrown away
+		for i := range p.loops {
+			kept := p.loops[i].pending_break_jumps[:0]
+			for _, break_index := range p.loops[i].pending_break_jumps {
+				if break_index < previous_instruction_amount {
+					kept = append(kept, break_index)
+				}
+			}
+			p.loops[i].pending_break_jumps = kept
+		}
+		p.synchronize(diagnostic, start_index)
+		instructions, returns = nil, false
+	}()
+	instructions, returns = p.parse_statement(previous_instruction_amount)
+	return mark_origin(instructions, p.tokens[start_index].Offset), returns
+}
+
+// synchronize skips to where the next statement probably starts: the first
+// token on a later line than the error, or the `}` closing the enclosing
+// block. Braced blocks met along the way are skipped whole. If the token
+// the statement choked on already looks like such a boundary it is handed
+// back, as long as that still leaves the statement starting at start_index
+// having consumed something.
+func (p *Parser) synchronize(diagnostic diagnostics.Error, start_index int) {
+	if p.index-1 > start_index {
+		failing := p.tokens[p.index-1]
+		if failing.Line == diagnostic.Line && failing.Column == diagnostic.Column {
+			starts_line := p.tokens[p.index-2].Line < failing.Line
+			closes_block := failing.Value == "}" && p.block_depth > 0
+			if starts_line || closes_block {
+				p.index--
+				return
+			}
+		}
+	}
+	// blocks the statement opened before failing still need closing
+	depth := 0
+	for _, t := range p.tokens[start_index:p.index] {
+		if t.Value == "{" {
+			depth++
+		} else if t.Value == "}" && depth > 0 {
+			depth--
+		}
+	}
+	for p.in_range() {
+		t := p.cur_token()
+		if depth == 0 && ((t.Value == "}" && p.block_depth > 0) || t.Line > diagnostic.Line) {
+			return
+		}
+		if t.Value == "{" {
+			depth++
+		} else if t.Value == "}" && depth > 0 {
+			depth--
+		}
+		p.index++
+	}
+}
+
+// NextToken consumes and returns the current token. At the end it keeps
+// returning the trailing EOF token, which carries the end-of-file position.
+func (p *Parser) NextToken() tokenizer.Token {
+	if !p.in_range() {
+		return p.tokens[len(p.tokens)-1]
+	}
+	token := p.tokens[p.index]
+	p.index++
+	return token
+}
+
+// block_instructions compiles source into instructions numbered from
+// previous_instruction_amount. Every problem found comes back as a
+// diagnostics.List, alongside the instructions for the statements that did
+// compile.
+func (program *Program) block_instructions(source string, previous_instruction_amount int) ([]Instruction, error) {
+	tokens, err := tokenizer.Tokenize(source)
+	p := Parser{source: source, tokens: tokens, index: 0, program: program}
+	if err != nil {
+		p.errors = append(p.errors, err.(diagnostics.List)...)
+	}
+	instructions := p.parse_block(previous_instruction_amount)
+	// tokenizer errors were recorded before any parser error; report in
+	// source order regardless
+	p.errors.Sort()
+	return instructions, p.errors.Err()
+}
+
+func (p *Parser) parse_block(previous_instruction_amount int) []Instruction {
+	bytecode := []Instruction{}
+	for p.in_range() {
+		statement, _ := p.parse_statement_or_recover(len(bytecode) + previous_instruction_amount)
+		bytecode = append(bytecode, statement...)
+	}
+	return bytecode
+}
@@ -0,0 +1,235 @@
+package vm
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPrecedence(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{"1 + 2 * 3", "7"},
+		{"(1 + 2) * 3", "9"},
+		{"10 - 4 - 3", "3"},
+		{"24 / 4 / 3", "2"},
+		{"2 * 3 + 4 * 5", "26"},
+		{"-2 * 3", "-6"},
+		{"-(2 + 3)", "-5"},
+		{"1 + 2 < 4", "true"},
+		{"1 + 2 == 3", "true"},
+		{"1 < 2 == true", "true"},
+		{"!false == true", "true"},
+		{"true || false && false", "true"},
+		{"(true || false) && false", "false"},
+		{"1 < 2 && 3 > 4 || 5 == 5", "true"},
+		{"\"a\" + \"b\" == \"ab\"", "true"},
+	}
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			got, err := run_source(t, "print_all("+test.expression+")")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != lines(test.want) {
+				t.Errorf("%s printed %q, want %s", test.expression, got, test.want)
+			}
+		})
+	}
+}
+
+func TestControlFlow(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"if else chain", `fn sign(n int) string {
+    if n < 0 {
+        return "negative"
+    } else if n == 0 {
+        return "zero"
+    } else {
+        return "positive"
+    }
+}
+print_all(sign(-3), sign(0), sign(8))`, lines("negative", "zero", "positive")},
+		{"break leaves the innermost loop", `fn f() {
+    let i = 0
+    while i < 3 {
+        let j = 0
+        while true {
+            if j == 2 {
+                break
+            }
+            j = j + 1
+        }
+        print_all(i * 10 + j)
+        i = i + 1
+    }
+}
+f()`, lines("2", "12", "22")},
+		{"continue skips the rest of the body", `fn f() {
+    let i = 0
+    while i < 6 {
+        i = i + 1
+        let odd = i - i / 2 * 2
+        if odd == 1 {
+            continue
+        }
+        print_all(i)
+    }
+}
+f()`, lines("2", "4", "6")},
+		{"break and continue pop block locals", `fn f() int {
+    let total = 0
+    let i = 0
+    while i < 10 {
+        let step = 1
+        i = i + step
+        if i == 3 {
+            let skipped = i
+            continue
+        }
+        if i == 6 {
+            let last = i
+            break
+        }
+        total = total + i
+    }
+    return total
+}
+print_all(f())`, lines("12")},
+		{"return inside a loop with locals", `fn h(n int) int {
+    let i = 0
+    while i < n {
+        let a = i
+        i = i + 1
+        if a == 100 {
+            return a
+        }
+    }
+    let b = 5
+    return b
+}
+print_all(h(3), h(200))`, lines("5", "100")},
+		{"void function falls off the end", `fn g(x int) {
+    let a = 1
+    if x > 0 {
+        return
+    }
+}
+g(0)
+g(1)
+print_all("finished")`, lines("finished")},
+		{"every branch returns", `fn f(a bool) int {
+    if a {
+        let z = 1
+        return z
+    } else {
+        return 2
+    }
+}
+print_all(f(true), f(false))`, lines("1", "2")},
+		{"function declared inside a block", `var n int
+n = 3
+while n > 0 {
+    if true {
+        fn f(x int) int {
+            return x * 10
+        }
+    }
+    n = n - 1
+    print_all(f(n))
+    if n == 1 {
+        break
+    }
+}`, lines("20", "10")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := run_source(t, test.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("printed %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{"missing return", `fn f(x int) int {
+    if x > 0 {
+        return 1
+    }
+}`, []string{"5:1: function f must return a value of type int on every path"}},
+		{"missing return after else without return", `fn f(a bool) int {
+    if a {
+        let z = 1
+    } else {
+        return 2
+    }
+}`, []string{"7:1: function f must return a value of type int on every path"}},
+		{"unknown return type", `fn f() Foo {
+    return 1
+}`, []string{"1:8: function f must return an int, a float, a bool or a string, got Foo"}},
+		{"class return type", `class A {
+    a int
+}
+fn f() A {
+}`, []string{"4:8: function f must return an int, a float, a bool or a string, got A"}},
+		{"break outside a loop", "break", []string{"1:1: break outside of a loop"}},
+		{"continue outside a loop", "continue", []string{"1:1: continue outside of a loop"}},
+		{"undeclared assignment", "x = 1", []string{"1:1: x is not declared; declare it with var x <type> or let x = <value>"}},
+		{"var inside a top-level block", `if true {
+    var g int
+}`, []string{"2:5: globals can only be declared outside of blocks"}},
+		{"let inside a top-level block", `while true {
+    let g = 1
+}`, []string{"2:5: globals can only be declared outside of blocks"}},
+		{"recovers after each bad statement", `let a = 1
+let = 2
+let b = )
+print_all(a)`, []string{"2:5: Expected variable name, got ASSIGN(=)", "3:9: Unexpected token: PUNCTUATION())"}},
+		{"errors come in source order", `let s = "abc
+let b = $`, []string{"1:9: unterminated string literal", "2:9: unknown character '$'", "2:10: Unexpected token: EOF"}},
+		{"whole local object", `class P {
+    a int
+}
+fn f() {
+    var p P
+    var q P
+    print_all(q)
+}`, []string{"7:15: cannot use q of type P as a value"}},
+		{"assign a whole local object", `class P {
+    a int
+}
+fn f() {
+    var p P
+    p = 1
+}`, []string{"6:5: cannot assign to p of type P"}},
+		{"void argument", `fn v() {
+}
+print_all(1, v())`, []string{"3:10: argument 2 of print_all must be a value, got void"}},
+		{"wrong builtin argument", `print_one("a")`, []string{"1:10: argument 1 of print_one must be int, got string"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Compile(test.source)
+			if err == nil {
+				t.Fatalf("Compile succeeded, want %q", test.want)
+			}
+			if got := error_lines(err); !slices.Equal(got, test.want) {
+				t.Errorf("errors %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package vm
+
+import (
+	"fmt"
+
+	"no-ast/diagnostics"
+)
+
+type VarInfo struct {
+	Name       string
+	Type       string
+	mem_offset int
+}
+
+type Function struct {
+	Name                    string
+	param_types             []string
+	return_type             string
+	instruction_start_index int
+	local_vars              map[string]VarInfo
+}
+
+type Class struct {
+	Name       string
+	fieldsInfo map[string]VarInfo
+}
+
+type TypeSafeValue struct {
+	Type string
+	Data any
+}
+
+// String prints v the way assembly spells a constant: {int 3},
+// {float 2.5}, {bool true}, {string "hi"} or {void}.
+func (v TypeSafeValue) String() string {
+	switch data := v.Data.(type) {
+	case nil:
+		return "{" + v.Type + "}"
+	case string:
+		return fmt.Sprintf("{%s %q}", v.Type, data)
+	case float64:
+		return fmt.Sprintf("{%s %s}", v.Type, format_float(data))
+	default:
+		return fmt.Sprintf("{%s %v}", v.Type, data)
+	}
+}
+
+// Program is a compiled script: its instructions together with the global
+// symbol table and the initial memory image they were compiled against.
+// Running a Program never modifies it, so any number of VMs can share one.
+type Program struct {
+	Instructions []Instruction
+	vars         map[string]VarInfo
+	memory       []any
+	// next_global_offset is the first memory cell not yet owned by a global.
+	next_global_offset int
+	// names and constants are what operand_name and operand_constant
+	// operands index; see name and constant.
+	names          []string
+	name_index     map[string]int
+	constants      []TypeSafeValue
+	constant_index map[TypeSafeValue]int
+	// code is Instructions after link, which is what the VM runs.
+	code []Instruction
+	// source is what the program was compiled or assembled from, which
+	// instruction origins point into; it is empty for a loaded program.
+	source string
+}
+
+// Compile turns source into a Program. On failure the error is a
+// diagnostics.List, whether the source does not parse, refers to something
+// that does not exist or hands a value of the wrong type to an operator,
+// function or variable, and the Program only holds the statements that did
+// compile; it is still useful for tooling but must not be run.
+func Compile(source string) (*Program, error) {
+	program := new_program()
+	program.source = source
+	instructions, err := program.block_instructions(source, 0)
+	program.Instructions = append(instructions, Instruction{Opcode: Halt})
+	if err != nil {
+		return program, err
+	}
+	return program, program.prepare()
+}
+
+// diagnostic builds the error for instruction i, pointing into the source
+// the instruction came from when that is known and naming the instruction
+// otherwise.
+func (program *Program) diagnostic(i int, message string) diagnostics.Error {
+	if i < len(program.Instructions) && program.Instructions[i].origin > 0 && program.source != "" {
+		return diagnostics.Locate(program.source, program.Instructions[i].origin-1, message)
+	}
+	return diagnostics.Error{Message: fmt.Sprintf("instruction %d: %s", i, message)}
+}
+
+// new_program returns an empty Program whose globals are the builtins
+// registered so far.
+func new_program() *Program {
+	program := &Program{
+		vars:           map[string]VarInfo{},
+		name_index:     map[string]int{},
+		constant_index: map[TypeSafeValue]int{},
+	}
+	for _, b := range registered_builtins() {
+		program.memory[program.allocate_global(b.name, "builtin-function").mem_offset] = b
+	}
+	return program
+}
+
+// name returns the operand that refers to s, adding it to the program's
+// names the first time.
+func (program *Program) name(s string) int {
+	index, ok := program.name_index[s]
+	if !ok {
+		index = len(program.names)
+		program.names = append(program.names, s)
+		program.name_index[s] = index
+	}
+	return index
+}
+
+// constant returns the operand that refers to v, adding it to the program's
+// constants the first time. v must hold an int, a float, a bool, a string or
+// nothing.
+func (program *Program) constant(v TypeSafeValue) int {
+	index, ok := program.constant_index[v]
+	if !ok {
+		index = len(program.constants)
+		program.constants = append(program.constants, v)
+		program.constant_index[v] = index
+	}
+	return index
+}
+
+// format prints instruction with its names and constants spelled out, the
+// way assembly writes it.
+func (program *Program) format(instruction Instruction) string {
+	layout, ok := operand_layouts[instruction.Opcode]
+	if !ok {
+		return instruction.String()
+	}
+	res := opcode_names[instruction.Opcode]
+	for i, kind := range layout {
+		switch operand := instruction.Operands[i]; kind {
+		case operand_int:
+			res += " " + fmt.Sprint(operand)
+		case operand_name:
+			res += " " + program.names[operand]
+		case operand_constant:
+			res += " " + program.constants[operand].String()
+		}
+	}
+	return res
+}
+
+// lookup_builtin returns the builtin a global name refers to, if any.
+func (program *Program) lookup_builtin(name string) (*builtin, bool) {
+	v, ok := program.vars[name]
+	if !ok || v.Type != "builtin-function" {
+		return nil, false
+	}
+	return program.memory[v.mem_offset].(*builtin), true
+}
+
+// get_type_size returns how many memory cells a value of type t occupies.
+// Every primitive fits in one cell; a class instance is laid out as its
+// fields back to back.
+func (program *Program) get_type_size(t string) int {
+	switch t {
+	case "int", "float", "bool", "string":
+		return 1
+	case "builtin-function":
+		return 1
+	case "function":
+		return 1
+	case "class":
+		return 1
+	default:
+		size := 0
+		for _, field := range program.lookup_class(t).fieldsInfo {
+			size += program.get_type_size(field.Type)
+		}
+		return size
+	}
+}
+
+// is_primitive reports whether t is a type whose values fit in one cell, and
+// so can be assigned, passed and returned whole.
+func is_primitive(t string) bool {
+	return t == "int" || t == "float" || t == "bool" || t == "string"
+}
+
+// is_data_type reports whether t names something a variable or field can
+// hold: a primitive or a declared class.
+func (program *Program) is_data_type(t string) bool {
+	if is_primitive(t) {
+		return true
+	}
+	v, ok := program.vars[t]
+	return ok && v.Type == "class"
+}
+
+func (program *Program) lookup_class(name string) Class {
+	v, ok := program.vars[name]
+	if !ok || v.Type != "class" {
+		panic(fmt.Sprintf("unknown type %s", name))
+	}
+	return program.memory[v.mem_offset].(Class)
+}
+
+// allocate_global declares a global of type_, growing memory to make room
+// for it.
+func (program *Program) allocate_global(name string, type_ string) VarInfo {
+	v := VarInfo{Name: name, Type: type_, mem_offset: program.next_global_offset}
+	program.next_global_offset += program.get_type_size(type_)
+	program.vars[name] = v
+	for len(program.memory) < program.next_global_offset {
+		program.memory = append(program.memory, nil)
+	}
+	return v
+}
+
+// zero_memory writes the zero value of type_ into the cells starting at
+// mem_offset, recursing into class fields.
+func (program *Program) zero_memory(mem_offset int, type_ string) {
+	switch type_ {
+	case "int":
+		program.memory[mem_offset] = 0
+	case "float":
+		program.memory[mem_offset] = 0.0
+	case "bool":
+		program.memory[mem_offset] = false
+	case "string":
+		program.memory[mem_offset] = ""
+	default:
+		for _, field := range program.lookup_class(type_).fieldsInfo {
+			program.zero_memory(mem_offset+field.mem_offset, field.Type)
+		}
+	}
+}
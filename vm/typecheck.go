@@ -0,0 +1,353 @@
+package vm
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"no-ast/diagnostics"
+)
+
+// type_error is an instruction that would be handed values of the wrong
+// type.
+type type_error struct {
+	instruction int
+	message     string
+}
+
+// abstract_value is what the type checker knows about a value on the stack.
+type abstract_value struct {
+	type_ string
+	// callee is the Function or *builtin a function value is known to be.
+	callee any
+}
+
+// type_checker runs program.code on types instead of values: every
+// instruction pops the types of its operands off a type stack, checks them
+// and pushes the type of its result. It follows both sides of every
+// conditional jump, and each function body is checked on its own, starting
+// from its parameters.
+type type_checker struct {
+	program *Program
+	code    []Instruction
+	errors  []type_error
+	// function and return_type describe the body being checked.
+	function    string
+	return_type string
+	// states is the stack of types each instruction of the body is reached
+	// with, and work the instructions whose successors are still unchecked.
+	states map[int][]abstract_value
+	work   []int
+	// short_circuits maps where each && or || jumps to back to the jump.
+	short_circuits map[int]int
+}
+
+// prepare links program and type checks the result, which is everything a
+// program needs before it can run.
+func (program *Program) prepare() error {
+	if err := program.link(); err != nil {
+		return err
+	}
+	return program.typecheck()
+}
+
+// typecheck checks the linked program, so link must have succeeded. Values
+// of the wrong type are reported as a diagnostics.List.
+func (program *Program) typecheck() error {
+	c := type_checker{program: program, code: program.code, short_circuits: map[int]int{}}
+	c.check_body(0, len(c.code), nil)
+	var functions []Function
+	for _, cell := range program.memory {
+		if function, ok := cell.(Function); ok {
+			functions = append(functions, function)
+		}
+	}
+	slices.SortFunc(functions, func(a, b Function) int { return a.instruction_start_index - b.instruction_start_index })
+	for _, function := range functions {
+		c.function, c.return_type = function.Name, function.return_type
+		params := make([]abstract_value, len(function.param_types))
+		for i, param_type := range function.param_types {
+			params[i] = abstract_value{type_: param_type}
+		}
+		start := function.instruction_start_index
+		// a function body sits behind the jump that skips it, whose target
+		// is where the body ends
+		if start == 0 || start >= len(c.code) || c.code[start-1].Opcode != Jump || c.code[start-1].Operands[0] <= start {
+			c.fail(start, "%s does not start behind a jump over its body", function.Name)
+			continue
+		}
+		c.check_body(start, c.code[start-1].Operands[0], params)
+	}
+	if len(c.errors) == 0 {
+		return nil
+	}
+	slices.SortStableFunc(c.errors, func(a, b type_error) int { return a.instruction - b.instruction })
+	errors := make(diagnostics.List, len(c.errors))
+	for i, e := range c.errors {
+		errors[i] = program.diagnostic(e.instruction, e.message)
+	}
+	errors.Sort()
+	return errors
+}
+
+// check_body checks everything reachable from start within [start, end),
+// which is entered with stack. Every instruction must be reached with the
+// same stack of types along every path, and a function may only leave its
+// body by returning.
+func (c *type_checker) check_body(start int, end int, stack []abstract_value) {
+	c.states = map[int][]abstract_value{}
+	c.work = nil
+	if start < end {
+		c.enter(start, stack)
+	}
+	for len(c.work) > 0 {
+		i := c.work[len(c.work)-1]
+		c.work = c.work[:len(c.work)-1]
+		stack := slices.Clone(c.states[i])
+		for _, next := range c.step(i, &stack) {
+			if next < start || next >= end {
+				if c.function != "" {
+					c.fail(i, "missing return: %s can leave its body without returning", c.function)
+				}
+				continue
+			}
+			c.enter(next, stack)
+		}
+	}
+}
+
+// enter records that instruction i can be reached with stack, queueing it
+// to be checked the first time.
+func (c *type_checker) enter(i int, stack []abstract_value) {
+	seen, ok := c.states[i]
+	if !ok {
+		c.states[i] = stack
+		c.work = append(c.work, i)
+		return
+	}
+	if same_types(seen, stack) {
+		return
+	}
+	// the jump of an && or || arrives with a bool, so the right-hand side
+	// has to produce one too
+	if jump, ok := c.short_circuits[i]; ok && len(seen) == len(stack) && len(stack) > 0 {
+		right := stack[len(stack)-1].type_
+		if right == "bool" {
+			right = seen[len(seen)-1].type_
+		}
+		c.fail(jump, "%s needs two bools, got bool and %s", short_circuit_operator(c.code[jump].Opcode), right)
+		return
+	}
+	c.fail(i, "reached with stack %s and with %s", type_list(seen), type_list(stack))
+}
+
+func short_circuit_operator(opcode Opcode) string {
+	if opcode == JumpIfTrue_orPop {
+		return "||"
+	}
+	return "&&"
+}
+
+func same_types(a []abstract_value, b []abstract_value) bool {
+	return slices.EqualFunc(a, b, func(x, y abstract_value) bool { return x.type_ == y.type_ })
+}
+
+func type_list(stack []abstract_value) string {
+	types := make([]string, len(stack))
+	for i, v := range stack {
+		types[i] = v.type_
+	}
+	return "[" + strings.Join(types, " ") + "]"
+}
+
+func (c *type_checker) fail(i int, format string, args ...any) {
+	c.errors = append(c.errors, type_error{instruction: i, message: fmt.Sprintf(format, args...)})
+}
+
+// step applies instruction i to stack and returns where execution can go
+// next. After a type error it carries on with the type the instruction
+// should have produced, so that one run reports as many mistakes as it can.
+func (c *type_checker) step(i int, stack *[]abstract_value) []int {
+	instruction := c.code[i]
+	pop := func(count int) []abstract_value {
+		popped := (*stack)[len(*stack)-count:]
+		*stack = (*stack)[:len(*stack)-count]
+		return popped
+	}
+	pop_pair := func() (string, string) {
+		operands := pop(2)
+		return operands[0].type_, operands[1].type_
+	}
+	push := func(type_ string) { *stack = append(*stack, abstract_value{type_: type_}) }
+	if needed := operands_popped(instruction); len(*stack) < needed {
+		c.fail(i, "%s needs %d values on the stack, has %d", opcode_names[instruction.Opcode], needed, len(*stack))
+		return nil
+	}
+
+	switch instruction.Opcode {
+	case OPCODE_SUB, OPCODE_MUL, OPCODE_DIV:
+		left, right := pop_pair()
+		if !is_number(left) || !is_number(right) {
+			c.fail(i, "%s needs two numbers, got %s and %s", opcode_names[instruction.Opcode], left, right)
+		}
+		push(arithmetic_type(left, right))
+	case OPCODE_ADD, OPCODE_GT, OPCODE_GE, OPCODE_LT, OPCODE_LE:
+		left, right := pop_pair()
+		if !(is_number(left) && is_number(right)) && !(left == "string" && right == "string") {
+			c.fail(i, "%s needs two numbers or two strings, got %s and %s", opcode_names[instruction.Opcode], left, right)
+		}
+		if instruction.Opcode == OPCODE_ADD {
+			push(arithmetic_type(left, right))
+		} else {
+			push("bool")
+		}
+	case OPCODE_EQ, OPCODE_NE:
+		left, right := pop_pair()
+		if !(is_number(left) && is_number(right)) && !(is_primitive(left) && left == right) {
+			c.fail(i, "%s cannot compare %s and %s", opcode_names[instruction.Opcode], left, right)
+		}
+		push("bool")
+	case OPCODE_INDEX, OPCODE_SLICE:
+		operands := pop(operands_popped(instruction))
+		if operands[0].type_ != "string" {
+			c.fail(i, "%s needs a string, got %s", opcode_names[instruction.Opcode], operands[0].type_)
+		}
+		for _, index := range operands[1:] {
+			if index.type_ != "int" {
+				c.fail(i, "string indices must be ints, got %s", index.type_)
+			}
+		}
+		push("string")
+	case OPCODE_NEG:
+		operand := pop(1)[0]
+		if !is_number(operand.type_) {
+			c.fail(i, "NEG needs a number, got %s", operand.type_)
+		}
+		push(arithmetic_type(operand.type_, "int"))
+	case OPCODE_NOT:
+		if operand := pop(1)[0]; operand.type_ != "bool" {
+			c.fail(i, "NOT needs a bool, got %s", operand.type_)
+		}
+		push("bool")
+	case Push:
+		push(c.program.constants[instruction.Operands[0]].Type)
+	case Pop:
+		pop(1)
+	case AccessMemory_andSkipBlanks:
+		value := abstract_value{type_: c.program.names[instruction.Operands[1]]}
+		switch cell := c.program.memory[instruction.Operands[0]].(type) {
+		case Function, *builtin:
+			value.callee = cell
+		}
+		*stack = append(*stack, value)
+		return []int{instruction.Operands[2]}
+	case StoreMemory_andSkipBlanks:
+		type_ := c.program.names[instruction.Operands[1]]
+		if value := pop(1)[0]; value.type_ != type_ {
+			c.fail(i, "cannot assign %s to a variable of type %s", value.type_, type_)
+		}
+		return []int{instruction.Operands[2]}
+	case LoadLocal, SetLocal:
+		slot, type_ := instruction.Operands[0], c.program.names[instruction.Operands[1]]
+		if instruction.Opcode == SetLocal {
+			if value := pop(1)[0]; value.type_ != type_ {
+				c.fail(i, "cannot assign %s to a local of type %s", value.type_, type_)
+			}
+		}
+		if slot < 0 || slot >= len(*stack) || (*stack)[slot].type_ != type_ {
+			c.fail(i, "local slot %d does not hold a %s", slot, type_)
+		}
+		if instruction.Opcode == LoadLocal {
+			push(type_)
+		}
+	case Invoke_function_on_stack_top:
+		arg_count := instruction.Operands[0]
+		args := slices.Clone(pop(arg_count))
+		callee := pop(1)[0]
+		return_type, ok := c.check_call(i, callee, args)
+		if !ok {
+			return nil
+		}
+		push(return_type)
+	case Return:
+		if c.function == "" {
+			c.fail(i, "return outside of a function")
+			return nil
+		}
+		if result := pop(1)[0]; result.type_ != c.return_type {
+			c.fail(i, "%s must return %s, got %s", c.function, c.return_type, result.type_)
+		}
+		return nil
+	case JumpIfFalse:
+		if condition := pop(1)[0]; condition.type_ != "bool" {
+			c.fail(i, "condition must be a bool, got %s", condition.type_)
+		}
+		return []int{i + 1, instruction.Operands[0]}
+	case JumpIfFalse_orPop, JumpIfTrue_orPop:
+		if condition := (*stack)[len(*stack)-1]; condition.type_ != "bool" {
+			c.fail(i, "%s needs two bools, got %s", short_circuit_operator(instruction.Opcode), condition.type_)
+			(*stack)[len(*stack)-1] = abstract_value{type_: "bool"}
+		}
+		c.short_circuits[instruction.Operands[0]] = i
+		c.enter(instruction.Operands[0], slices.Clone(*stack))
+		pop(1)
+	case Jump:
+		return []int{instruction.Operands[0]}
+	case Halt:
+		return nil
+	default:
+		c.fail(i, "unexpected %s", opcode_names[instruction.Opcode])
+		return nil
+	}
+	return []int{i + 1}
+}
+
+// is_number reports whether arithmetic works on values of type_; an int
+// meeting a float is promoted to a float.
+func is_number(type_ string) bool {
+	return type_ == "int" || type_ == "float"
+}
+
+// operands_popped is how many values instruction takes off the stack.
+func operands_popped(instruction Instruction) int {
+	switch instruction.Opcode {
+	case OPCODE_ADD, OPCODE_SUB, OPCODE_MUL, OPCODE_DIV, OPCODE_EQ, OPCODE_NE, OPCODE_GT, OPCODE_GE, OPCODE_LT, OPCODE_LE, OPCODE_INDEX:
+		return 2
+	case OPCODE_SLICE:
+		return 2 + instruction.Operands[0]
+	case FieldAccess, OPCODE_NEG, OPCODE_NOT, Pop, StoreMemory_andSkipBlanks, SetLocal, Return, JumpIfFalse, JumpIfFalse_orPop, JumpIfTrue_orPop:
+		return 1
+	case Invoke_function_on_stack_top:
+		return instruction.Operands[0] + 1
+	}
+	return 0
+}
+
+// check_call checks calling callee with args and returns the call's type,
+// which is still known after bad arguments as long as the callee is.
+func (c *type_checker) check_call(i int, callee abstract_value, args []abstract_value) (string, bool) {
+	arg_types := make([]string, len(args))
+	for j, arg := range args {
+		arg_types[j] = arg.type_
+	}
+	switch function := callee.callee.(type) {
+	case *builtin:
+		if problem := function.check_arguments(arg_types); problem != "" {
+			c.fail(i, "%s", problem)
+		}
+		return function.return_type, true
+	case Function:
+		if len(arg_types) != len(function.param_types) {
+			c.fail(i, "%s expects %d arguments, got %d", function.Name, len(function.param_types), len(arg_types))
+			return function.return_type, true
+		}
+		for j, arg_type := range arg_types {
+			if arg_type != function.param_types[j] {
+				c.fail(i, "argument %d of %s must be %s, got %s", j+1, function.Name, function.param_types[j], arg_type)
+			}
+		}
+		return function.return_type, true
+	}
+	c.fail(i, "cannot call a %s", callee.type_)
+	return "", false
+}
@@ -0,0 +1,85 @@
+package vm
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLinkAndTypeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{"unknown variable", "print_all(nope)", []string{"1:11: unknown variable nope"}},
+		{"unknown field", `class P {
+    a int
+}
+var p P
+print_all(p.b)`, []string{"5:13: P has no field b"}},
+		{"field of a primitive", `var n int
+print_all(n.b)`, []string{"2:13: n has no field b: int is not a class"}},
+		{"whole global object", `class P {
+    a int
+}
+var p P
+print_all(p)`, []string{"5:11: cannot use p of type P as a value"}},
+		{"class as a value", `class P {
+    a int
+}
+print_all(P)`, []string{"4:11: cannot use P of type class as a value"}},
+		{"assign a whole global object", `class P {
+    a int
+}
+var p P
+var q P
+p = q.a`, []string{"6:1: cannot assign to p of type P"}},
+		{"arithmetic on a bool", "let x = 1 + true", []string{"1:11: ADD needs two numbers or two strings, got int and bool"}},
+		{"wrong return type", `fn f(a int) int {
+    return a < 2
+}`, []string{"2:5: f must return int, got bool"}},
+		{"condition is not a bool", `let n = 1
+if n {
+}`, []string{"2:1: condition must be a bool, got int"}},
+		{"logic on an int", "let b = 1 && true", []string{"1:11: && needs two bools, got int"}},
+		{"several errors at once", `let a = 1 + true
+let b = "s" - 1`, []string{"1:11: ADD needs two numbers or two strings, got int and bool", "2:13: SUB needs two numbers, got string and int"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Compile(test.source)
+			if err == nil {
+				t.Fatalf("Compile succeeded, want %q", test.want)
+			}
+			if got := error_lines(err); !slices.Equal(got, test.want) {
+				t.Errorf("errors %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMissingReturnInBytecode(t *testing.T) {
+	program, err := Compile(`fn f(x int) int {
+    if x > 0 {
+        return 1
+    } else {
+        return 2
+    }
+}
+print_all(f(0))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// turning the last return into a pop lets the body run past its end,
+	// which the parser would never emit but a hand-written program can
+	last := slices.IndexFunc(program.Instructions, func(instruction Instruction) bool { return instruction.Opcode == Jump })
+	end := program.Instructions[last].Operands[0]
+	program.Instructions[end-1] = Instruction{Opcode: Pop}.at(0)
+	err = program.prepare()
+	if err == nil {
+		t.Fatal("prepare succeeded, want a missing return")
+	}
+	if got, want := error_lines(err), []string{"1:1: missing return: f can leave its body without returning"}; !slices.Equal(got, want) {
+		t.Errorf("errors %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,351 @@
+package vm
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"no-ast/utils/assert"
+	"os"
+	"slices"
+)
+
+// check_interval is how many instructions run between context checks.
+const check_interval = 1024
+
+// VM runs one Program. Each VM owns its memory, stack and frames, so any
+// number of them can run side by side, even on the same Program.
+type VM struct {
+	// Stdout receives everything the print builtins write.
+	Stdout io.Writer
+
+	program *Program
+	memory  []any
+	stack   []TypeSafeValue
+	frames  []StackFrame
+	halted  bool
+}
+
+type StackFrame struct {
+	return_address              int
+	function_locals_start_index int
+	return_type                 string
+}
+
+// New prepares a VM for program.
+func New(program *Program) *VM {
+	return &VM{
+		Stdout:  os.Stdout,
+		program: program,
+	}
+}
+
+// Run executes the program from the start until it halts, fails or ctx is
+// done. Every run starts afresh from the program's initial memory image, so
+// a VM can run its program any number of times.
+func (vm *VM) Run(ctx context.Context) error {
+	vm.memory = slices.Clone(vm.program.memory)
+	vm.stack = vm.stack[:0]
+	vm.frames = vm.frames[:0]
+	vm.halted = false
+	return vm.execute(ctx)
+}
+
+// execute runs the program's linked code from its first instruction until it halts or falls
+// off the end, checking ctx every check_interval instructions. A failing
+// instruction panics; the panic is turned into the returned error.
+func (vm *VM) execute(ctx context.Context) (err error) {
+	instruction_ptr := 0
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("runtime error at instruction %d: %v", instruction_ptr, r)
+		}
+	}()
+	steps := 0
+	code := vm.program.code
+	for instruction_ptr < len(code) {
+		steps++
+		if steps%check_interval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		instruction := &code[instruction_ptr]
+		// for stack_thing := range vm.stack {
+		// 	displayStruct.Print(stack_thing)
+		// }
+		// displayStruct.Print(instruction)
+		switch instruction.Opcode {
+		case OPCODE_ADD:
+			right := vm.stack_pop()
+			left := vm.stack_pop()
+			if left.Type == "string" && right.Type == "string" {
+				vm.stack = append(vm.stack, TypeSafeValue{Type: "string", Data: left.Data.(string) + right.Data.(string)})
+				break
+			}
+			if left.Type == "int" && right.Type == "int" {
+				vm.stack = append(vm.stack, TypeSafeValue{Type: "int", Data: left.Data.(int) + right.Data.(int)})
+				break
+			}
+			l, r := float_operands(OPCODE_ADD, left, right)
+			vm.stack = append(vm.stack, TypeSafeValue{Type: "float", Data: l + r})
+		case OPCODE_SUB:
+			right := vm.stack_pop()
+			left := vm.stack_pop()
+			if left.Type == "int" && right.Type == "int" {
+				vm.stack = append(vm.stack, TypeSafeValue{Type: "int", Data: left.Data.(int) - right.Data.(int)})
+				break
+			}
+			l, r := float_operands(OPCODE_SUB, left, right)
+			vm.stack = append(vm.stack, TypeSafeValue{Type: "float", Data: l - r})
+		case OPCODE_MUL:
+			right := vm.stack_pop()
+			left := vm.stack_pop()
+			if left.Type == "int" && right.Type == "int" {
+				vm.stack = append(vm.stack, TypeSafeValue{Type: "int", Data: left.Data.(int) * right.Data.(int)})
+				break
+			}
+			l, r := float_operands(OPCODE_MUL, left, right)
+			vm.stack = append(vm.stack, TypeSafeValue{Type: "float", Data: l * r})
+		case OPCODE_DIV:
+			right := vm.stack_pop()
+			left := vm.stack_pop()
+			if left.Type == "int" && right.Type == "int" {
+				vm.stack = append(vm.stack, TypeSafeValue{Type: "int", Data: left.Data.(int) / right.Data.(int)})
+				break
+			}
+			l, r := float_operands(OPCODE_DIV, left, right)
+			vm.stack = append(vm.stack, TypeSafeValue{Type: "float", Data: l / r})
+		case LoadLocal:
+			offset := instruction.Operands[0]
+			type_ := vm.program.names[instruction.Operands[1]]
+			var_stack_index := vm.frames[len(vm.frames)-1].function_locals_start_index + offset
+			vm.stack = append(vm.stack, TypeSafeValue{Type: type_, Data: vm.stack[var_stack_index].Data})
+		case SetLocal:
+			offset := instruction.Operands[0]
+			type_ := vm.program.names[instruction.Operands[1]]
+			var_stack_index := vm.frames[len(vm.frames)-1].function_locals_start_index + offset
+			if vm.stack[var_stack_index].Type != type_ {
+				assert.Assert(vm.stack[len(vm.stack)-1].Type != type_, "something has gone wrong within the compiler")
+				panic(fmt.Sprintf("expected %s, got %s", type_, vm.stack[var_stack_index].Type))
+			}
+			vm.stack[var_stack_index].Data = vm.stack_pop().Data
+		case Push:
+			vm.stack = append(vm.stack, vm.program.constants[instruction.Operands[0]])
+		case Pop:
+			vm.stack_pop()
+		case Invoke_function_on_stack_top:
+			arg_count := instruction.Operands[0]
+			// println(arg_count, "arg_count")
+			function := vm.stack[len(vm.stack)-1-arg_count]
+			if function.Type == "builtin-function" {
+				args := slices.Clone(vm.stack[len(vm.stack)-arg_count:])
+				result := function.Data.(*builtin).call(vm, args)
+				vm.stack = vm.stack[:len(vm.stack)-1-arg_count]
+				vm.stack = append(vm.stack, result)
+				if vm.halted {
+					return nil
+				}
+
+			} else if function.Type == "function" {
+				if len(function.Data.(Function).param_types) != arg_count {
+					panic(fmt.Sprintf("expected %d args, got %d", len(function.Data.(Function).param_types), arg_count))
+				}
+				for i := 0; i < arg_count; i++ {
+					if function.Data.(Function).param_types[i] != vm.stack[len(vm.stack)-arg_count+i].Type {
+						panic(fmt.Sprintf("expected %s, got %s for arg %d", function.Data.(Function).param_types[i], vm.stack[len(vm.stack)-arg_count+i].Type, i))
+					}
+				}
+				vm.frames = append(vm.frames, StackFrame{return_address: instruction_ptr + 1, function_locals_start_index: len(vm.stack) - arg_count, return_type: function.Data.(Function).return_type})
+				instruction_ptr = function.Data.(Function).instruction_start_index
+				continue
+			} else {
+				panic("unhandled Invoke_function_on_stack_top")
+			}
+
+		case JumpIfFalse:
+			if vm.stack[len(vm.stack)-1].Type != "bool" {
+				panic("condition is a " + vm.stack[len(vm.stack)-1].Type + ", not a bool")
+			}
+			if !vm.stack_pop().Data.(bool) {
+				instruction_ptr = instruction.Operands[0]
+				continue
+			}
+		case JumpIfFalse_orPop, JumpIfTrue_orPop:
+			condition := vm.stack[len(vm.stack)-1]
+			if condition.Type != "bool" {
+				panic(fmt.Sprintf("%s on %s", opcode_names[instruction.Opcode], condition.Type))
+			}
+			if condition.Data.(bool) == (instruction.Opcode == JumpIfTrue_orPop) {
+				instruction_ptr = instruction.Operands[0]
+				continue
+			}
+			vm.stack_pop()
+		case Jump:
+			instruction_ptr = instruction.Operands[0]
+			continue
+		case Return:
+			if len(vm.frames) == 0 {
+				panic("return from main")
+			}
+			frame := vm.frames[len(vm.frames)-1]
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			result := vm.stack_pop()
+			if result.Type != frame.return_type {
+				panic(fmt.Sprintf("expected %s return value, got %s", frame.return_type, result.Type))
+			}
+			// drop the locals and the callee itself, which sits just below them
+			vm.stack = vm.stack[:frame.function_locals_start_index-1]
+			vm.stack = append(vm.stack, result)
+			instruction_ptr = frame.return_address
+			continue
+		case OPCODE_NEG:
+			operand := vm.stack_pop()
+			switch operand.Type {
+			case "int":
+				vm.stack = append(vm.stack, TypeSafeValue{Type: "int", Data: -operand.Data.(int)})
+			case "float":
+				vm.stack = append(vm.stack, TypeSafeValue{Type: "float", Data: -operand.Data.(float64)})
+			default:
+				panic("neg on " + operand.Type)
+			}
+		case OPCODE_NOT:
+			operand := vm.stack_pop()
+			if operand.Type != "bool" {
+				panic("not on " + operand.Type)
+			}
+			vm.stack = append(vm.stack, TypeSafeValue{Type: "bool", Data: !operand.Data.(bool)})
+		case OPCODE_EQ, OPCODE_NE, OPCODE_GT, OPCODE_GE, OPCODE_LT, OPCODE_LE:
+			right := vm.stack_pop()
+			left := vm.stack_pop()
+			vm.stack = append(vm.stack, TypeSafeValue{Type: "bool", Data: compare(instruction.Opcode, left, right)})
+		case OPCODE_INDEX:
+			index := vm.stack_pop().Data.(int)
+			s := vm.stack_pop().Data.(string)
+			if index < 0 || index >= len(s) {
+				panic(fmt.Sprintf("index %d out of range for a string of length %d", index, len(s)))
+			}
+			vm.stack = append(vm.stack, TypeSafeValue{Type: "string", Data: s[index : index+1]})
+		case OPCODE_SLICE:
+			has_end := instruction.Operands[0] == 1
+			end := 0
+			if has_end {
+				end = vm.stack_pop().Data.(int)
+			}
+			start := vm.stack_pop().Data.(int)
+			s := vm.stack_pop().Data.(string)
+			if !has_end {
+				end = len(s)
+			}
+			if start < 0 || start > end || end > len(s) {
+				panic(fmt.Sprintf("slice [%d:%d] out of range for a string of length %d", start, end, len(s)))
+			}
+			vm.stack = append(vm.stack, TypeSafeValue{Type: "string", Data: s[start:end]})
+		case Halt:
+			return nil
+		case AccessMemory_andSkipBlanks:
+			offset := instruction.Operands[0]
+			type_ := vm.program.names[instruction.Operands[1]]
+			vm.stack = append(vm.stack, TypeSafeValue{Type: type_, Data: vm.memory[offset]})
+			instruction_ptr = instruction.Operands[2]
+			continue
+		case StoreMemory_andSkipBlanks:
+			type_ := vm.program.names[instruction.Operands[1]]
+			value := vm.stack_pop()
+			if value.Type != type_ {
+				panic(fmt.Sprintf("cannot assign %s to a %s", value.Type, type_))
+			}
+			vm.memory[instruction.Operands[0]] = value.Data
+			instruction_ptr = instruction.Operands[2]
+			continue
+		default:
+			panic("unhandled " + instruction.String())
+		}
+		instruction_ptr++
+	}
+	return nil
+}
+
+func (vm *VM) stack_pop() TypeSafeValue {
+	v := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return v
+}
+
+// compare reports whether the comparison opcode op holds between two
+// numbers, two strings or two bools; false orders before true. A float
+// compares the IEEE way, so NaN is unordered and unequal even to itself.
+func compare(op Opcode, left TypeSafeValue, right TypeSafeValue) bool {
+	switch {
+	case left.Type == "int" && right.Type == "int":
+		return comparison_holds(op, cmp.Compare(left.Data.(int), right.Data.(int)))
+	case left.Type == "string" && right.Type == "string":
+		return comparison_holds(op, cmp.Compare(left.Data.(string), right.Data.(string)))
+	case left.Type == "bool" && right.Type == "bool":
+		return comparison_holds(op, cmp.Compare(bool_rank(left.Data.(bool)), bool_rank(right.Data.(bool))))
+	}
+	l, r := float_operands(op, left, right)
+	switch op {
+	case OPCODE_EQ:
+		return l == r
+	case OPCODE_NE:
+		return l != r
+	case OPCODE_GT:
+		return l > r
+	case OPCODE_GE:
+		return l >= r
+	case OPCODE_LT:
+		return l < r
+	case OPCODE_LE:
+		return l <= r
+	}
+	panic("not a comparison: " + opcode_names[op])
+}
+
+// float_operands converts the operands of the opcode op to floats, promoting
+// ints, and panics if either is not a number.
+func float_operands(op Opcode, left TypeSafeValue, right TypeSafeValue) (float64, float64) {
+	l, left_ok := as_float(left)
+	r, right_ok := as_float(right)
+	if !left_ok || !right_ok {
+		panic(fmt.Sprintf("%s on %s and %s", opcode_names[op], left.Type, right.Type))
+	}
+	return l, r
+}
+
+func as_float(v TypeSafeValue) (float64, bool) {
+	switch v.Type {
+	case "int":
+		return float64(v.Data.(int)), true
+	case "float":
+		return v.Data.(float64), true
+	}
+	return 0, false
+}
+
+func bool_rank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// comparison_holds reports whether the comparison opcode is true of two
+// values that compare puts in order.
+func comparison_holds(opcode Opcode, order int) bool {
+	switch opcode {
+	case OPCODE_EQ:
+		return order == 0
+	case OPCODE_NE:
+		return order != 0
+	case OPCODE_GT:
+		return order > 0
+	case OPCODE_GE:
+		return order >= 0
+	case OPCODE_LT:
+		return order < 0
+	case OPCODE_LE:
+		return order <= 0
+	}
+	panic("not a comparison: " + opcode_names[opcode])
+}
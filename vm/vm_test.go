@@ -0,0 +1,195 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"no-ast/diagnostics"
+)
+
+// run_program runs program and returns what it printed.
+func run_program(t *testing.T, program *Program) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	machine := New(program)
+	machine.Stdout = &out
+	err := machine.Run(context.Background())
+	return out.String(), err
+}
+
+// run_source compiles and runs source, failing the test if it does not
+// compile, and returns what it printed.
+func run_source(t *testing.T, source string) (string, error) {
+	t.Helper()
+	program, err := Compile(source)
+	if err != nil {
+		t.Fatalf("Compile:\n%s\n%v", source, err)
+	}
+	return run_program(t, program)
+}
+
+// lines joins one printed value per line, the way print_all prints them.
+func lines(values ...string) string {
+	return strings.Join(values, "\n") + "\n"
+}
+
+// error_lines is every error in err as line:column: message, or just the
+// message for one without a position.
+func error_lines(err error) []string {
+	var list diagnostics.List
+	if !errors.As(err, &list) {
+		return []string{err.Error()}
+	}
+	out := make([]string, len(list))
+	for i, e := range list {
+		e.Snippet = ""
+		out[i] = e.Error()
+	}
+	return out
+}
+
+// read_example returns the source of one of the examples.
+func read_example(t *testing.T, name string) string {
+	t.Helper()
+	source, err := os.ReadFile("../examples/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(source)
+}
+
+var examples = []string{"demo.src", "loop.src", "strings.src", "floats.src", "bools.src"}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"int arithmetic", "print_all(7 + 3, 7 - 3, 7 * 3, 7 / 2, -7)", lines("10", "4", "21", "3", "-7")},
+		{"float promotion", "print_all(1 + 0.5, 3 / 2.0, 2.0 * 2, -1.5)", lines("1.5", "1.5", "4.0", "-1.5")},
+		{"string operations", `let s = "hello"
+print_all(s + "!", len(s), s[1], s[1:3], s[:2], s[3:])`, lines("hello!", "5", "e", "el", "he", "lo")},
+		{"comparisons", "print_all(1 < 2, 2 <= 2, 3 > 4, 3 >= 4, 1 == 1, 1 != 1)", lines("true", "true", "false", "false", "true", "false")},
+		{"mixed comparisons", "print_all(1 < 1.5, 2 == 2.0, \"a\" < \"b\", false == false)", lines("true", "true", "true", "true")},
+		{"nan is unordered", `let nan = 0.0 / 0.0
+print_all(nan == nan, nan != nan, nan < 1.0, nan >= 1.0, 1 > nan, nan <= nan)`, lines("false", "true", "false", "false", "false", "false")},
+		{"signed zero", "print_all(-0.0 == 0.0, -0.0 < 0.0)", lines("true", "false")},
+		{"short circuit skips the right side", `fn loud(b bool) bool {
+    print_all("evaluated")
+    return b
+}
+print_all(false && loud(true), true || loud(false), true && loud(false))`, lines("evaluated", "false", "true", "false")},
+		{"globals and fields", `class Point {
+    x int
+    y int
+}
+var p Point
+p.x = 3
+p.y = p.x * 2
+print_all(p.x, p.y)`, lines("3", "6")},
+		{"local objects", `class Point {
+    x int
+    y int
+}
+fn f() int {
+    var p Point
+    p.x = 4
+    p.y = 5
+    return p.x + p.y
+}
+print_all(f())`, lines("9")},
+		{"recursion", `fn fib(n int) int {
+    if n < 2 {
+        return n
+    }
+    return fib(n-1) + fib(n-2)
+}
+print_all(fib(15))`, lines("610")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := run_source(t, test.source)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("printed %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"index past the end", `let s = "abc"
+print_all(s[3])`, "index 3 out of range"},
+		{"negative index", `let s = "abc"
+print_all(s[-1])`, "index -1 out of range"},
+		{"slice past the end", `let s = "abc"
+print_all(s[1:5])`, "out of range"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := run_source(t, test.source)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Run error = %v, want one containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestExamplesRun(t *testing.T) {
+	for _, name := range examples {
+		t.Run(name, func(t *testing.T) {
+			if _, err := run_source(t, read_example(t, name)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRunTwice(t *testing.T) {
+	program, err := Compile(`let x = 0
+while x < 2 {
+    x = x + 1
+    print_one(x)
+}
+done()
+print_one(9)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	machine := New(program)
+	machine.Stdout = &out
+	for run := 1; run <= 2; run++ {
+		out.Reset()
+		if err := machine.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if want := lines("1", "2", "done the program"); out.String() != want {
+			t.Errorf("run %d printed %q, want %q", run, out.String(), want)
+		}
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	program, err := Compile("while true {\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := New(program).Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run = %v, want context.Canceled", err)
+	}
+}